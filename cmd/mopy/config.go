@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+// printConfig prints the Mopyfile in args as mopy reads it. With -resolved, it is loaded like in a build, so the
+// defaults are applied, the target is selected and the referenced files are read. Mopyfiles of apiVersion v2 are
+// converted into the layout of v1 the build works on, so they are printed as v1.
+func printConfig(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	resolved := flags.Bool("resolved", false, "apply defaults and the target like in a build")
+	target := flags.String("target", "", "the target of the Mopyfile to resolve")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file := flags.Arg(0)
+	if file == "" {
+		file = "Mopyfile.yaml"
+	}
+
+	var c *config.Config
+	if *resolved {
+		loaded, err := config.NewFromFilename(file)
+		if err != nil {
+			return errors.Wrap(err, "opening Mopyfile")
+		}
+		if c, err = loaded.ForTarget(*target); err != nil {
+			return err
+		}
+	} else {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return errors.Wrap(err, "reading Mopyfile")
+		}
+		if c, err = config.Parse(b); err != nil {
+			return err
+		}
+	}
+
+	// the keys printed are the ones of v1, even if converted from v2
+	c.ApiVersion = "v1"
+	b, err := c.Yaml(*resolved)
+	if err != nil {
+		return errors.Wrap(err, "marshal config")
+	}
+	_, err = out.Write(b)
+
+	return err
+}
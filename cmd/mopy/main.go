@@ -4,10 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
-	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
 	"github.com/moby/buildkit/frontend/gateway/grpcclient"
 	"github.com/moby/buildkit/util/appcontext"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"gitlab.com/cmdjulian/mopy/pkg/config"
 	llbUtils "gitlab.com/cmdjulian/mopy/pkg/llb"
@@ -19,22 +20,68 @@ var filename string
 var outputLLB bool
 var outputDockerfile bool
 var buildkit bool
+var platform string
+var target string
 
 func main() {
+	// mopy validate [Mopyfile...]
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if !validate(os.Args[2:], os.Stderr) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// mopy config [-resolved] [-target name] [Mopyfile]
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := printConfig(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// mopy migrate [-w] [Mopyfile]
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// mopy schema [-check] [file]
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := schema(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.BoolVar(&outputLLB, "llb", false, "print llb to stdout")
 	flag.BoolVar(&outputDockerfile, "dockerfile", false, "print equivalent Dockerfile to stdout")
 	flag.BoolVar(&buildkit, "buildkit", true, "establish connection to buildkit and issue build")
 	flag.StringVar(&filename, "filename", "Mopyfile.yaml", "the Mopyfile to build from")
+	flag.StringVar(&target, "target", "", "the target of the Mopyfile to print the Dockerfile and llb for")
+	flag.StringVar(&platform, "platform", platforms.DefaultString(), "the target platform of the printed Dockerfile and llb")
 	flag.Parse()
 
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	p = platforms.Normalize(p)
+
 	if outputDockerfile {
-		if err := printDockerfile(filename); err != nil {
+		if err := printDockerfile(filename, p); err != nil {
 			os.Exit(1)
 		}
 	}
 
 	if outputLLB {
-		if err := printLlb(filename, os.Stdout); err != nil {
+		if err := printLlb(filename, p, os.Stdout); err != nil {
 			os.Exit(1)
 		}
 	}
@@ -46,26 +93,25 @@ func main() {
 	}
 }
 
-func printDockerfile(filename string) error {
-	c, err := config.NewFromFilename(filename)
+func printDockerfile(filename string, p ocispecs.Platform) error {
+	c, err := loadConfig(filename)
 	if err != nil {
-		return errors.Wrap(err, "opening Mopyfile")
+		return err
 	}
-	dockerfile := llbUtils.Mopyfile2LLB(c)
+	dockerfile := llbUtils.Mopyfile2Dockerfile(c, p)
 	fmt.Println(dockerfile)
 
 	return nil
 }
 
-func printLlb(filename string, out io.Writer) error {
-	c, err := config.NewFromFilename(filename)
+func printLlb(filename string, p ocispecs.Platform, out io.Writer) error {
+	c, err := loadConfig(filename)
 	if err != nil {
-		return errors.Wrap(err, "opening Mopyfile")
+		return err
 	}
-	dockerfile := llbUtils.Mopyfile2LLB(c)
-	st, _, _, _, err := dockerfile2llb.Dockerfile2LLB(context.TODO(), []byte(dockerfile), dockerfile2llb.ConvertOpt{})
+	st, _, err := llbUtils.Mopyfile2LLB(context.TODO(), c, llbUtils.Opt{Platform: &p})
 	if err != nil {
-		return errors.Wrap(err, "converting Dockerfile to LLB") // Added error check
+		return errors.Wrap(err, "converting Mopyfile to LLB")
 	}
 	dt, err := st.Marshal(context.Background())
 	if err != nil {
@@ -74,3 +120,15 @@ func printLlb(filename string, out io.Writer) error {
 
 	return llb.WriteTo(dt, out)
 }
+
+func loadConfig(filename string) (*config.Config, error) {
+	c, err := config.NewFromFilename(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening Mopyfile")
+	}
+	for _, warning := range c.Warnings {
+		fmt.Fprintf(os.Stderr, "%s:%s\n", filename, warning)
+	}
+
+	return c.ForTarget(target)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+// migrate rewrites the Mopyfile in args from apiVersion v1 to v2 and prints it. With -w, the file is replaced instead.
+func migrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the Mopyfile instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file := flags.Arg(0)
+	if file == "" {
+		file = "Mopyfile.yaml"
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "reading Mopyfile")
+	}
+
+	migrated, err := config.Migrate(b)
+	if err != nil {
+		return err
+	}
+
+	if *write {
+		return os.WriteFile(file, migrated, 0o644)
+	}
+	_, err = out.Write(migrated)
+
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+// schema prints the JSON Schema of the Mopyfile or writes it to the file given in args. With -check, the file is only
+// compared to the generated schema, so CI fails if it wasn't regenerated after changing the config types.
+func schema(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	check := flags.Bool("check", false, "fail if the file differs from the generated schema instead of writing it")
+	version := flags.String("version", "v1", "the apiVersion of the Mopyfile to generate the schema for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	generated, err := config.Schema(*version)
+	if err != nil {
+		return errors.Wrap(err, "generating schema")
+	}
+
+	file := flags.Arg(0)
+	switch {
+	case file == "" && *check:
+		return errors.New("-check requires the file to compare")
+	case file == "":
+		_, err := out.Write(generated)
+		return err
+	case *check:
+		current, err := os.ReadFile(file)
+		if err != nil {
+			return errors.Wrap(err, "reading schema")
+		}
+		if !bytes.Equal(current, generated) {
+			return fmt.Errorf("%s is outdated, regenerate it with 'go generate ./pkg/config'", file)
+		}
+		return nil
+	default:
+		return os.WriteFile(file, generated, 0o644)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+// validate checks the Mopyfiles in files without BuildKit and prints every problem found as file:line:column. Problems
+// without a position, like conflicting options or unreadable referenced files, are only checked if the file can be
+// located cleanly. It reports if all files are valid.
+func validate(files []string, out io.Writer) bool {
+	if len(files) == 0 {
+		files = []string{"Mopyfile.yaml"}
+	}
+
+	valid := true
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %s\n", file, err)
+			valid = false
+			continue
+		}
+
+		diagnostics := config.Lint(b)
+		for _, diagnostic := range diagnostics {
+			fmt.Fprintf(out, "%s:%s\n", file, diagnostic)
+		}
+		if len(diagnostics) > 0 {
+			valid = false
+			continue
+		}
+
+		if _, err := config.NewFromFilename(file); err != nil {
+			fmt.Fprintf(out, "%s: %s\n", file, err)
+			valid = false
+		}
+	}
+
+	return valid
+}
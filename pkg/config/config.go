@@ -2,19 +2,41 @@ package config
 
 import (
 	"fmt"
+	"github.com/distribution/reference"
+	"github.com/moby/sys/signal"
 	"github.com/pkg/errors"
 	"gitlab.com/cmdjulian/mopy/pkg/utils"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	InstallerPip = "pip"
+	InstallerUv  = "uv"
+)
+
+var apiVersions = []string{apiVersionV1, apiVersionV2}
+var installers = []string{InstallerPip, InstallerUv}
+
+var pythonVersionPattern = regexp.MustCompile(`^[2-9](\.\d{1,2})?(\.\d{1,2})?$`)
 var httpPattern = regexp.MustCompile(`^http(s)?://`)
 var gitHttpPattern = regexp.MustCompile(`^git\+http(s)?://`)
+var secretIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+var modulePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+var scriptPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+var portPattern = regexp.MustCompile(`^(\d{1,5})(/(tcp|udp|sctp))?$`)
+var userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+var hashPinnedPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(\[[^\]]+\])?==[^\s=]+(\s+--hash=sha256:[0-9a-fA-F]{64})+$`)
 
 // NewFromFilename returns a new config from a filename
 func NewFromFilename(filename string) (*Config, error) {
@@ -28,50 +50,249 @@ func NewFromFilename(filename string) (*Config, error) {
 		return nil, errors.Wrap(err, "reading config file")
 	}
 
-	return NewFromBytes(contents)
+	c, err := NewFromBytes(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.LoadFiles(func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(filepath.Dir(filename), name))
+	})
+
+	return c, err
 }
 
 func NewFromBytes(b []byte) (*Config, error) {
-	c := &Config{}
-	if err := yaml.Unmarshal(b, c); err != nil {
-		return nil, errors.Wrap(err, "unmarshal config")
+	c, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyDefaults(reflect.ValueOf(c)); err != nil {
+		return nil, errors.Wrap(err, "applying defaults")
 	}
+	c.Warnings = unknownKeysOf(b)
 
 	return c, c.Validate()
 }
 
+// Parse unmarshals the Mopyfile b according to its apiVersion, without applying defaults or validating it. Mopyfiles
+// of v2 are converted, so the result is the same for both versions.
+func Parse(b []byte) (*Config, error) {
+	var version struct {
+		ApiVersion string `yaml:"apiVersion"`
+	}
+	if err := yaml.Unmarshal(b, &version); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config")
+	}
+
+	if version.ApiVersion != apiVersionV2 {
+		c := &Config{}
+		if err := yaml.Unmarshal(b, c); err != nil {
+			return nil, errors.Wrap(err, "unmarshal config")
+		}
+		return c, nil
+	}
+
+	v2 := &ConfigV2{}
+	if err := yaml.Unmarshal(b, v2); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config")
+	}
+
+	return v2.config()
+}
+
+// configType returns the type the Mopyfile of apiVersion is decoded into.
+func configType(apiVersion string) reflect.Type {
+	if apiVersion == apiVersionV2 {
+		return reflect.TypeOf(ConfigV2{})
+	}
+
+	return reflect.TypeOf(Config{})
+}
+
+// Strict returns an error listing the warnings of the config, if there are any.
+func (c *Config) Strict() error {
+	if len(c.Warnings) == 0 {
+		return nil
+	}
+
+	warnings := make([]string, len(c.Warnings))
+	for i, warning := range c.Warnings {
+		warnings[i] = warning.String()
+	}
+
+	return fmt.Errorf("unknown keys in strict mode: %s", strings.Join(warnings, "; "))
+}
+
+// LoadFiles loads the files referenced by the config, like the pyproject.toml, through read. Paths passed to read are
+// relative to the build context.
+func (c *Config) LoadFiles(read func(name string) ([]byte, error)) error {
+	if c.Pyproject != nil {
+		b, err := read(c.Pyproject.File())
+		if err != nil {
+			return errors.Wrap(err, "reading pyproject.toml")
+		}
+		if err := c.Pyproject.Load(b); err != nil {
+			return err
+		}
+	}
+
+	if c.Poetry != nil {
+		b, err := read(c.Poetry.File())
+		if err != nil {
+			return errors.Wrap(err, "reading poetry.lock")
+		}
+		pyproject := func() ([]byte, error) { return read(c.Poetry.PyprojectFile()) }
+		if err := c.Poetry.Load(b, pyproject); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 type Config struct {
-	ApiVersion      string            `default:"v1" yaml:"apiVersion"`
-	PythonVersion   string            `yaml:"python"`
-	Apt             []string          `yaml:"build-deps"`
-	Envs            map[string]string `yaml:"envs"`
-	Indices         []Index           `yaml:"indices"`
-	PipDependencies []string          `yaml:"pip"`
-	Project         string            `yaml:"project"`
-	Labels          map[string]string `yaml:"labels"`
-	Sbom            *bool             `default:"true" yaml:"sbom"`
+	ApiVersion      string            `default:"v1" yaml:"apiVersion" description:"API version of the Mopyfile format. Helps manage future compatibility."`
+	PythonVersion   string            `yaml:"python" required:"true" description:"The Python interpreter version to use. Formats: '3', '3.9', or '3.9.1'."`
+	Apt             []string          `yaml:"build-deps" description:"Additional 'apt' packages to install before starting the build. These are not part of the final image."`
+	Envs            map[string]string `yaml:"envs" description:"Additional environment variables. These are present in the build and in the run stage."`
+	Indices         []Index           `yaml:"indices" description:"Additional list of pip indices to consider for installing dependencies."`
+	PipDependencies []string          `yaml:"pip" description:"List of pip dependencies to install. Supports package names, versions, git URLs, HTTP(S) URLs, and local paths."`
+	Project         string            `yaml:"project" description:"Relative path to a Python file or folder. If a folder, it must contain a 'main.py'. Sets the entrypoint for the final image if present."`
+	Pyproject       *Pyproject        `yaml:"pyproject" description:"Install a PEP 621 project from its pyproject.toml. Either the relative path or an object."`
+	Poetry          *Poetry           `yaml:"poetry" description:"Install the packages pinned in a poetry.lock. Either the relative path or an object."`
+	Installer       string            `default:"pip" yaml:"installer" description:"Installer used to install the dependencies in the build stage."`
+	RequireHashes   bool              `default:"false" yaml:"require-hashes" description:"Only allow pip dependencies pinned with == and a sha256 hash, installed in pip's hash checking mode."`
+	NoPypi          bool              `default:"false" yaml:"no-pypi" description:"Never consult PyPI. The primary index, or the first index if none is primary, replaces it."`
+	Labels          map[string]string `yaml:"labels" description:"Additional labels to add to the final image. These have precedence over automatically added labels. Placeholders like ${mopy.sbom} are supported."`
+	Sbom            *bool             `default:"true" yaml:"sbom" description:"Whether to add an SBOM (Software Bill of Materials) label containing pip dependencies to the image."`
+	Base            *Base             `yaml:"base"`
+	Entrypoint      []string          `yaml:"entrypoint" description:"Entrypoint of the final image. Can't be combined with module or script."`
+	Cmd             []string          `yaml:"cmd" description:"Arguments passed to the entrypoint of the final image."`
+	Module          string            `yaml:"module" description:"Python module run with python -m. Can't be combined with entrypoint or script."`
+	Script          string            `yaml:"script" description:"Console script installed by pip to run. Can't be combined with entrypoint or module."`
+	Expose          []string          `yaml:"expose" description:"Ports to expose, like 8080 or 5353/udp."`
+	Volumes         []string          `yaml:"volumes" description:"Absolute paths declared as volumes."`
+	Healthcheck     *Healthcheck      `yaml:"healthcheck"`
+	StopSignal      string            `yaml:"stop-signal" description:"Signal sent to stop the container, like SIGINT or 2."`
+	Workdir         string            `yaml:"workdir" description:"Absolute working directory of the final image."`
+	User            *User             `yaml:"user"`
+	RuntimeDeps     []string          `yaml:"runtime-deps" description:"Additional apt packages installed into the final image. Forces a slim runtime image."`
+	Targets         map[string]Target `yaml:"targets" description:"Named images built from this file, selected with the target option."`
+
+	// TargetDependencies and TargetEnvs are set by ForTarget. They only apply on top of the common dependencies and to
+	// the final image, so all targets share the build stage.
+	TargetDependencies []string          `yaml:"-"`
+	TargetEnvs         map[string]string `yaml:"-"`
+
+	// Warnings are the unknown keys of the Mopyfile. They are ignored, unless the Mopyfile is loaded strictly.
+	Warnings []Diagnostic `yaml:"-"`
+}
+
+// User is the non-root user the final image runs as. The group defaults to the uid and the home to /home/<name>.
+type User struct {
+	Name string `default:"nonroot" yaml:"name" description:"Name of the user."`
+	Uid  *int   `default:"65532" yaml:"uid" description:"Uid of the user, root is not allowed."`
+	Gid  *int   `yaml:"gid" description:"Gid of the primary group, defaults to the uid."`
+	Home string `yaml:"home" description:"Absolute home of the user, defaults to /home/<name>."`
+}
+
+// Healthcheck is run by the container engine to check whether the container is healthy. The command is run without a
+// shell, as distroless images don't provide one.
+type Healthcheck struct {
+	Command  []string      `yaml:"command" required:"true" description:"Command run without a shell."`
+	Interval time.Duration `yaml:"interval" description:"Time between two checks, like 30s."`
+	Timeout  time.Duration `yaml:"timeout" description:"Time after which a check is considered failed, like 5s."`
+	Retries  int           `yaml:"retries" description:"Consecutive failures until the container is unhealthy."`
+}
+
+// Base overrides the images of the build stages, e.g. to use a mirror registry or hardened internal images.
+type Base struct {
+	Builder string `yaml:"builder" description:"Image the dependencies are installed in. Defaults to python:<version>, of the Debian release of a distroless runtime image."`
+	Runtime string `yaml:"runtime" description:"Image of the final stage. Has to provide Python, and the configured user if it has no shell to create it with."`
 }
 
 type Index struct {
-	Url      string `yaml:"url"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Trust    bool   `default:"false" yaml:"trust"`
+	Url      string `yaml:"url" required:"true" description:"URL of the additional pip index (e.g., 'https://pypi.org/simple')."`
+	Username string `yaml:"username" description:"Optional username for index authentication. Can be used for token-based auth if password is not set."`
+	Password string `yaml:"password" description:"Optional password for index authentication. Ignored if username is not set."`
+	Secret   string `yaml:"secret" description:"Id of a BuildKit secret holding the password or token for index authentication. Can't be combined with password."`
+	Trust    bool   `default:"false" yaml:"trust" description:"Whether to add the index's domain as a trusted host (e.g., for self-signed certificates or HTTP)."`
+	Primary  bool   `default:"false" yaml:"primary" description:"Replace PyPI with this index instead of adding it as extra index. Only one index can be primary."`
+}
+
+// URL returns the parsed url of the index. Validate rejects malformed urls, an unvalidated malformed url is empty.
+func (i Index) URL() *url.URL {
+	u, err := url.Parse(i.Url)
+	if err != nil {
+		return &url.URL{}
+	}
+
+	return u
+}
+
+// validIndexUrl reports if raw is an absolute http or https url.
+func validIndexUrl(raw string) bool {
+	u, err := url.Parse(raw)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
 func (c *Config) Validate() error {
-	if c.ApiVersion != "" && c.ApiVersion != "v1" {
-		return fmt.Errorf("unknown version %s. Known versions: 'v1'", c.ApiVersion)
+	if c.ApiVersion != "" && !slices.Contains(apiVersions, c.ApiVersion) {
+		return fmt.Errorf("unknown version %s. Known versions: %s", c.ApiVersion, quoted(apiVersions))
 	}
 
 	if c.PythonVersion == "" {
 		return errors.New("empty is not a valid Python Version")
 	}
-	match, _ := regexp.MatchString("^[2-9](\\.\\d{1,2})?(\\.\\d{1,2})?$", c.PythonVersion)
-	if !match {
+	if !pythonVersionPattern.MatchString(c.PythonVersion) {
 		return fmt.Errorf("%s is not a valid Python Version", c.PythonVersion)
 	}
 
+	if c.Installer != "" && !slices.Contains(installers, c.Installer) {
+		return fmt.Errorf("unknown installer %s. Known installers: %s", c.Installer, quoted(installers))
+	}
+
+	var primaries []string
+	for _, index := range c.Indices {
+		if index.Primary {
+			primaries = append(primaries, index.Url)
+		}
+	}
+	if len(primaries) > 1 {
+		return fmt.Errorf("only one index can be primary, found: %s", strings.Join(primaries, ", "))
+	}
+	if c.NoPypi && len(c.Indices) == 0 {
+		return errors.New("no-pypi requires at least one index")
+	}
+
+	if c.Base != nil {
+		for _, ref := range []string{c.Base.Builder, c.Base.Runtime} {
+			if ref == "" {
+				continue
+			}
+			if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+				return errors.Wrapf(err, "%s is not a valid base image", ref)
+			}
+		}
+	}
+
+	for _, index := range c.Indices {
+		if !validIndexUrl(index.Url) {
+			return fmt.Errorf("malformed index url %s, expected an http or https url", index.Url)
+		}
+		if index.Secret == "" {
+			continue
+		}
+		if index.Password != "" {
+			return fmt.Errorf("index %s can either have a password or a secret, not both", index.Url)
+		}
+		if !secretIdPattern.MatchString(index.Secret) {
+			return fmt.Errorf("%s is not a valid secret id for index %s", index.Secret, index.Url)
+		}
+	}
+
 	invalidPaths := c.dependenciesFilteredByPrefix("/")
 	if len(invalidPaths) > 0 {
 		return fmt.Errorf("local paths can only be relative, found: %s", strings.Join(invalidPaths, ", "))
@@ -86,13 +307,191 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	if err := c.validateEntrypoint(); err != nil {
+		return err
+	}
+
+	if err := c.validateTargets(); err != nil {
+		return err
+	}
+
+	if err := c.validateRuntime(); err != nil {
+		return err
+	}
+
+	if c.Pyproject != nil {
+		if err := c.Pyproject.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.RequireHashes {
+		if err := c.validateHashes(); err != nil {
+			return err
+		}
+	}
+
+	if c.Poetry != nil {
+		if err := c.Poetry.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateHashes ensures every dependency can be verified by pip's hash checking mode. Only requirements.txt files,
+// which are checked by pip itself, and dependencies pinned with == and at least one sha256 hash are accepted.
+func (c *Config) validateHashes() error {
+	var unpinned []string
+
+	for _, dependency := range c.PipDependencies {
+		if strings.HasPrefix(dependency, "./") && strings.HasSuffix(dependency, "/requirements.txt") {
+			continue
+		}
+		if !hashPinnedPattern.MatchString(dependency) {
+			unpinned = append(unpinned, dependency)
+		}
+	}
+
+	if len(unpinned) > 0 {
+		return fmt.Errorf("require-hashes needs every pip dependency pinned like 'name==version --hash=sha256:...', found: %s", strings.Join(unpinned, ", "))
+	}
+
+	if c.Pyproject != nil {
+		return errors.New("require-hashes can't be used together with pyproject, local projects can't be hash checked")
+	}
+
+	return nil
+}
+
+// validateEntrypoint ensures at most one way to start the image is configured.
+func (c *Config) validateEntrypoint() error {
+	var configured []string
+	if len(c.Entrypoint) > 0 {
+		configured = append(configured, "entrypoint")
+	}
+	if c.Module != "" {
+		configured = append(configured, "module")
+	}
+	if c.Script != "" {
+		configured = append(configured, "script")
+	}
+	if len(configured) > 1 {
+		return fmt.Errorf("only one of entrypoint, module and script can be set, found: %s", strings.Join(configured, ", "))
+	}
+
+	for _, arg := range c.Entrypoint {
+		if strings.TrimSpace(arg) == "" {
+			return errors.New("entrypoint arguments can't be empty")
+		}
+	}
+	if c.Module != "" && !modulePattern.MatchString(c.Module) {
+		return fmt.Errorf("%s is not a valid Python module", c.Module)
+	}
+	if c.Script != "" && !scriptPattern.MatchString(c.Script) {
+		return fmt.Errorf("%s is not a valid script name, it has to be the name of a console script", c.Script)
+	}
+
 	return nil
 }
 
+// validateRuntime validates the settings of the final image's config.
+func (c *Config) validateRuntime() error {
+	for _, port := range c.Expose {
+		match := portPattern.FindStringSubmatch(port)
+		if match == nil {
+			return fmt.Errorf("%s is not a valid port, expected format: 8080 or 8080/udp", port)
+		}
+		if number, _ := strconv.Atoi(match[1]); number < 1 || number > 65535 {
+			return fmt.Errorf("port %s is out of range", port)
+		}
+	}
+
+	for _, volume := range c.Volumes {
+		if !strings.HasPrefix(volume, "/") {
+			return fmt.Errorf("volume has to be an absolute path, found: %s", volume)
+		}
+	}
+
+	if c.Healthcheck != nil {
+		if len(c.Healthcheck.Command) == 0 {
+			return errors.New("healthcheck command can't be empty")
+		}
+		if c.Healthcheck.Interval < 0 || c.Healthcheck.Timeout < 0 || c.Healthcheck.Retries < 0 {
+			return errors.New("healthcheck interval, timeout and retries can't be negative")
+		}
+	}
+
+	if c.StopSignal != "" {
+		if _, err := signal.ParseSignal(c.StopSignal); err != nil {
+			return errors.Wrapf(err, "invalid stop-signal")
+		}
+	}
+
+	if c.Workdir != "" && !strings.HasPrefix(c.Workdir, "/") {
+		return fmt.Errorf("workdir has to be an absolute path, found: %s", c.Workdir)
+	}
+
+	for _, pkg := range c.RuntimeDeps {
+		if strings.TrimSpace(pkg) == "" {
+			return errors.New("runtime-deps can't contain empty packages")
+		}
+	}
+	if len(c.RuntimeDeps) > 0 && c.Base != nil && strings.Contains(c.Base.Runtime, "distroless") {
+		return fmt.Errorf("runtime-deps are installed with apt, which the distroless runtime image %s doesn't provide. Use a debian based runtime image like python:%s-slim instead", c.Base.Runtime, c.PythonVersion)
+	}
+
+	if c.User != nil {
+		if c.User.Name != "" && !userNamePattern.MatchString(c.User.Name) {
+			return fmt.Errorf("%s is not a valid user name", c.User.Name)
+		}
+		// the group may be root, as required by OpenShift, the user not
+		if c.User.Uid != nil && *c.User.Uid <= 0 {
+			return fmt.Errorf("uid has to be a positive number, the image can't run as root, found: %d", *c.User.Uid)
+		}
+		if c.User.Gid != nil && *c.User.Gid < 0 {
+			return fmt.Errorf("gid can't be negative, found: %d", *c.User.Gid)
+		}
+		if c.User.Home != "" && !strings.HasPrefix(c.User.Home, "/") {
+			return fmt.Errorf("home has to be an absolute path, found: %s", c.User.Home)
+		}
+	}
+
+	return nil
+}
+
+// PrimaryIndex returns the position of the index replacing PyPI or -1 if PyPI is used. With no-pypi and no explicit
+// primary index, the first index replaces PyPI.
+func (c *Config) PrimaryIndex() int {
+	for i, index := range c.Indices {
+		if index.Primary {
+			return i
+		}
+	}
+
+	if c.NoPypi && len(c.Indices) > 0 {
+		return 0
+	}
+
+	return -1
+}
+
+// HasDependencies reports if anything has to be installed by pip.
+func (c *Config) HasDependencies() bool {
+	return len(c.PipDependencies) > 0 || len(c.TargetDependencies) > 0 || c.Pyproject != nil || c.Poetry != nil
+}
+
 func (c *Config) MaskedDependencies() []string {
-	dependencies := c.PipDependencies
+	dependencies := append(append([]string{}, c.PipDependencies...), c.TargetDependencies...)
 
 	for i, dependency := range dependencies {
+		// hashes are only noise in the sbom
+		if pos := strings.Index(dependency, "--hash="); pos != -1 {
+			dependency = strings.TrimSpace(dependency[:pos])
+			dependencies[i] = dependency
+		}
+
 		switch {
 		case httpPattern.MatchString(dependency):
 			{
@@ -157,3 +556,8 @@ func (c *Config) dependenciesFilteredByPrefix(filter string) []string {
 
 	return filtered
 }
+
+// quoted returns values in single quotes, separated by commas.
+func quoted(values []string) string {
+	return "'" + strings.Join(values, "', '") + "'"
+}
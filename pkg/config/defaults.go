@@ -0,0 +1,179 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// applyDefaults sets the fields of the struct v without a value to their default tag. Nested objects are only
+// defaulted if they are present, e.g. the user defaults only apply if a user is configured.
+func applyDefaults(v reflect.Value) error {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name == "" || name == "-" {
+				continue
+			}
+			if value, ok := field.Tag.Lookup("default"); ok && v.Field(i).IsZero() {
+				if err := setDefault(v.Field(i), value); err != nil {
+					return errors.Wrapf(err, "default of %s", field.Name)
+				}
+			}
+			if err := applyDefaults(v.Field(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := applyDefaults(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		// map values aren't addressable, they are defaulted as copy
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := applyDefaults(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	}
+
+	return nil
+}
+
+// setDefault parses the default tag value into v. Lists are separated by commas.
+func setDefault(v reflect.Value, value string) error {
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(strings.Split(value, ",")))
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Yaml returns the config as Mopyfile. Keys without a value are omitted. With defaults, keys having a default are
+// always shown, so a config loaded by NewFromBytes shows the defaults applied.
+func (c *Config) Yaml(defaults bool) ([]byte, error) {
+	node, err := toNode(reflect.ValueOf(c), defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), encoder.Close()
+}
+
+func toNode(v reflect.Value, defaults bool) (*yaml.Node, error) {
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	node := &yaml.Node{}
+	switch {
+	case v.Kind() == reflect.Struct && v.Type() != durationType:
+		node.Kind = yaml.MappingNode
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if _, ok := field.Tag.Lookup("default"); (!ok || !defaults) && isEmpty(v.Field(i)) {
+				continue
+			}
+
+			value, err := toNode(v.Field(i), defaults)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, value)
+		}
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		node.Kind = yaml.SequenceNode
+		for i := 0; i < v.Len(); i++ {
+			item, err := toNode(v.Index(i), defaults)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+
+	case v.Kind() == reflect.Map && v.Type().Elem().Kind() == reflect.Struct:
+		node.Kind = yaml.MappingNode
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			value, err := toNode(v.MapIndex(key), defaults)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key.String()}, value)
+		}
+
+	default:
+		if err := node.Encode(v.Interface()); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
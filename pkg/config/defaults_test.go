@@ -0,0 +1,100 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	c, err := NewFromBytes([]byte(`python: "3.11"
+sbom: false
+poetry: ./poetry.lock
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Sbom == nil || *c.Sbom {
+		t.Errorf("Sbom = %v, want an explicit false to stay false", c.Sbom)
+	}
+	if c.ApiVersion != apiVersionV1 || c.Installer != InstallerPip {
+		t.Errorf("ApiVersion, Installer = %s, %s, want %s, %s", c.ApiVersion, c.Installer, apiVersionV1, InstallerPip)
+	}
+	if len(c.Poetry.Groups) != 1 || c.Poetry.Groups[0] != "main" {
+		t.Errorf("Poetry.Groups = %v, want [main]", c.Poetry.Groups)
+	}
+	if c.User != nil {
+		t.Errorf("User = %+v, want the user defaults to apply only if a user is configured", c.User)
+	}
+}
+
+func TestApplyDefaultsOfPresentBlocks(t *testing.T) {
+	c, err := NewFromBytes([]byte(`python: "3.11"
+user: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Sbom == nil || !*c.Sbom {
+		t.Errorf("Sbom = %v, want true", c.Sbom)
+	}
+	if c.User == nil || c.User.Name != "nonroot" || c.User.Uid == nil || *c.User.Uid != 65532 {
+		t.Errorf("User = %+v, want nonroot with uid 65532", c.User)
+	}
+}
+
+func TestYaml(t *testing.T) {
+	c, err := NewFromBytes([]byte(`python: "3.11"
+sbom: false
+poetry: ./poetry.lock
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		resolved bool
+		want     string
+	}{
+		{
+			name: "configured",
+			want: `apiVersion: v1
+python: "3.11"
+poetry:
+  lock: ./poetry.lock
+  groups:
+    - main
+installer: pip
+sbom: false
+`,
+		},
+		{
+			name:     "resolved",
+			resolved: true,
+			want: `apiVersion: v1
+python: "3.11"
+poetry:
+  lock: ./poetry.lock
+  groups:
+    - main
+installer: pip
+require-hashes: false
+no-pypi: false
+sbom: false
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Yaml(tt.resolved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Yaml() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
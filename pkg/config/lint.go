@@ -0,0 +1,288 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+var yamlErrorPattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Diagnostic is a problem found in a Mopyfile together with its position.
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+// Lint reports all problems of the Mopyfile b it can locate, like unknown keys, invalid values, absolute paths and
+// malformed index urls. Problems without a position, like conflicting options, are only reported by Validate.
+func Lint(b []byte) []Diagnostic {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return yamlDiagnostics(err)
+	}
+	if len(root.Content) == 0 {
+		return []Diagnostic{{Line: 1, Column: 1, Message: "the Mopyfile is empty"}}
+	}
+
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return []Diagnostic{at(doc, "the Mopyfile has to be a mapping")}
+	}
+
+	t := configType(apiVersionOf(doc))
+	diagnostics := unknownKeys(doc, t)
+
+	if err := doc.Decode(reflect.New(t).Interface()); err != nil {
+		diagnostics = append(diagnostics, yamlDiagnostics(err)...)
+	}
+
+	diagnostics = append(diagnostics, invalidValues(doc)...)
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].Line != diagnostics[j].Line {
+			return diagnostics[i].Line < diagnostics[j].Line
+		}
+		return diagnostics[i].Column < diagnostics[j].Column
+	})
+
+	return diagnostics
+}
+
+// unknownKeysOf reports the unknown keys of the Mopyfile b. Files which can't be parsed have none, loading them fails
+// anyway.
+func unknownKeysOf(b []byte) []Diagnostic {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+
+	return unknownKeys(root.Content[0], configType(apiVersionOf(root.Content[0])))
+}
+
+// apiVersionOf returns the apiVersion of the Mopyfile doc, empty if it isn't set.
+func apiVersionOf(doc *yaml.Node) string {
+	if node := value(doc, "apiVersion"); node != nil {
+		return node.Value
+	}
+
+	return ""
+}
+
+// unknownKeys reports the keys of node which aren't fields of t, recursing into nested objects, lists and maps.
+func unknownKeys(node *yaml.Node, t reflect.Type) []Diagnostic {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var diagnostics []Diagnostic
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				message := fmt.Sprintf("unknown key %s", key.Value)
+				if suggestion := closestKey(key.Value, fields); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %s?", suggestion)
+				}
+				diagnostics = append(diagnostics, at(key, message))
+				continue
+			}
+			diagnostics = append(diagnostics, unknownKeys(value, field)...)
+		}
+
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			diagnostics = append(diagnostics, unknownKeys(item, t.Elem())...)
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			diagnostics = append(diagnostics, unknownKeys(node.Content[i], t.Elem())...)
+		}
+	}
+
+	return diagnostics
+}
+
+// yamlFields returns the types of the fields of t by their yaml key.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = t.Field(i).Type
+	}
+
+	return fields
+}
+
+// closestKey returns the known key most similar to key or an empty string, if none of them is close enough to be
+// likely meant. Underscores count as dashes, as in build_deps for build-deps.
+func closestKey(key string, fields map[string]reflect.Type) string {
+	normalized := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+	known := maps.Keys(fields)
+	sort.Strings(known)
+
+	closest, best := "", 3
+	for _, candidate := range known {
+		if d := distance(normalized, strings.ToLower(candidate)); d < best && d < len(key) {
+			closest, best = candidate, d
+		}
+	}
+
+	return closest
+}
+
+// distance returns the Levenshtein distance of a and b.
+func distance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+func invalidValues(doc *yaml.Node) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	if node := value(doc, "apiVersion"); node != nil && !slices.Contains(apiVersions, node.Value) {
+		diagnostics = append(diagnostics, at(node, fmt.Sprintf("unknown version %s. Known versions: %s", node.Value, quoted(apiVersions))))
+	}
+
+	if node := value(doc, "python"); node == nil {
+		diagnostics = append(diagnostics, at(doc, "python is required"))
+	} else if !pythonVersionPattern.MatchString(node.Value) {
+		diagnostics = append(diagnostics, at(node, fmt.Sprintf("%s is not a valid Python Version", node.Value)))
+	}
+
+	diagnostics = append(diagnostics, localPaths(value(doc, "pip"))...)
+	diagnostics = append(diagnostics, localPaths(value(doc, "dependencies"))...)
+
+	diagnostics = append(diagnostics, absolutePath(value(doc, "project"), "project path can't be absolute")...)
+	diagnostics = append(diagnostics, absolutePath(shortForm(value(doc, "pyproject"), "path"), "pyproject path can't be absolute")...)
+	diagnostics = append(diagnostics, absolutePath(shortForm(value(doc, "poetry"), "lock"), "poetry lock path can't be absolute")...)
+
+	if node := value(doc, "indices"); node != nil {
+		for _, index := range node.Content {
+			if node := value(index, "url"); node != nil {
+				if !validIndexUrl(node.Value) {
+					diagnostics = append(diagnostics, at(node, fmt.Sprintf("malformed index url %s, expected an http or https url", node.Value)))
+				}
+			}
+		}
+	}
+
+	if node := value(doc, "targets"); node != nil && node.Kind == yaml.MappingNode {
+		for i := 1; i < len(node.Content); i += 2 {
+			diagnostics = append(diagnostics, absolutePath(value(node.Content[i], "project"), "project path can't be absolute")...)
+			diagnostics = append(diagnostics, localPaths(value(node.Content[i], "pip"))...)
+			diagnostics = append(diagnostics, localPaths(value(node.Content[i], "dependencies"))...)
+		}
+	}
+
+	return diagnostics
+}
+
+// localPaths reports the absolute paths of the dependencies, either pip strings of v1 or the objects of v2.
+func localPaths(dependencies *yaml.Node) []Diagnostic {
+	if dependencies == nil {
+		return nil
+	}
+
+	var diagnostics []Diagnostic
+	for _, dependency := range dependencies.Content {
+		if dependency.Kind == yaml.ScalarNode {
+			diagnostics = append(diagnostics, absolutePath(dependency, "local path can't be absolute")...)
+			continue
+		}
+		diagnostics = append(diagnostics, absolutePath(value(dependency, "path"), "local path can't be absolute")...)
+		diagnostics = append(diagnostics, absolutePath(value(dependency, "requirements"), "requirements path can't be absolute")...)
+	}
+
+	return diagnostics
+}
+
+func absolutePath(node *yaml.Node, message string) []Diagnostic {
+	if node == nil || node.Kind != yaml.ScalarNode || !strings.HasPrefix(node.Value, "/") {
+		return nil
+	}
+
+	return []Diagnostic{at(node, fmt.Sprintf("%s, has to be relative, found: %s", message, node.Value))}
+}
+
+// shortForm returns node itself if it is a scalar, otherwise the value of key.
+func shortForm(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind == yaml.ScalarNode {
+		return node
+	}
+
+	return value(node, key)
+}
+
+// value returns the value of key in the mapping node or nil if it isn't present.
+func value(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+func at(node *yaml.Node, message string) Diagnostic {
+	return Diagnostic{Line: node.Line, Column: node.Column, Message: message}
+}
+
+// yamlDiagnostics converts the errors reported by yaml, which only contain the line.
+func yamlDiagnostics(err error) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, match := range yamlErrorPattern.FindAllStringSubmatch(err.Error(), -1) {
+		line, _ := strconv.Atoi(match[1])
+		diagnostics = append(diagnostics, Diagnostic{Line: line, Column: 1, Message: match[2]})
+	}
+
+	if len(diagnostics) == 0 {
+		diagnostics = append(diagnostics, Diagnostic{Line: 1, Column: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")})
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name     string
+		mopyfile string
+		want     []Diagnostic
+	}{
+		{
+			name: "valid",
+			mopyfile: `apiVersion: v1
+python: 3.9
+pip:
+  - numpy
+`,
+		},
+		{
+			name:     "empty",
+			mopyfile: ``,
+			want:     []Diagnostic{{Line: 1, Column: 1, Message: "the Mopyfile is empty"}},
+		},
+		{
+			name:     "no mapping",
+			mopyfile: `- python`,
+			want:     []Diagnostic{{Line: 1, Column: 1, Message: "the Mopyfile has to be a mapping"}},
+		},
+		{
+			name: "invalid yaml",
+			mopyfile: `apiVersion: v1
+ python: 3.9
+`,
+			want: []Diagnostic{{Line: 2, Column: 1, Message: "mapping values are not allowed in this context"}},
+		},
+		{
+			name:     "missing python",
+			mopyfile: `apiVersion: v1`,
+			want:     []Diagnostic{{Line: 1, Column: 1, Message: "python is required"}},
+		},
+		{
+			name: "invalid values",
+			mopyfile: `apiVersion: v3
+python: "3.x"
+indices:
+  - url: ftp://mirror.company.org
+`,
+			want: []Diagnostic{
+				{Line: 1, Column: 13, Message: "unknown version v3. Known versions: 'v1', 'v2'"},
+				{Line: 2, Column: 9, Message: "3.x is not a valid Python Version"},
+				{Line: 4, Column: 10, Message: "malformed index url ftp://mirror.company.org, expected an http or https url"},
+			},
+		},
+		{
+			name: "wrong type",
+			mopyfile: `apiVersion: v1
+python: 3.9
+pip: numpy
+`,
+			want: []Diagnostic{{Line: 3, Column: 1, Message: "cannot unmarshal !!str `numpy` into []string"}},
+		},
+		{
+			name: "absolute paths",
+			mopyfile: `apiVersion: v1
+python: 3.9
+pip:
+  - numpy
+  - /opt/lib
+project: /app
+pyproject:
+  path: /pyproject.toml
+poetry: /poetry.lock
+targets:
+  api:
+    project: /api
+    pip: [ /opt/api ]
+`,
+			want: []Diagnostic{
+				{Line: 5, Column: 5, Message: "local path can't be absolute, has to be relative, found: /opt/lib"},
+				{Line: 6, Column: 10, Message: "project path can't be absolute, has to be relative, found: /app"},
+				{Line: 8, Column: 9, Message: "pyproject path can't be absolute, has to be relative, found: /pyproject.toml"},
+				{Line: 9, Column: 9, Message: "poetry lock path can't be absolute, has to be relative, found: /poetry.lock"},
+				{Line: 12, Column: 14, Message: "project path can't be absolute, has to be relative, found: /api"},
+				{Line: 13, Column: 12, Message: "local path can't be absolute, has to be relative, found: /opt/api"},
+			},
+		},
+		{
+			name: "absolute paths of v2",
+			mopyfile: `apiVersion: v2
+python: 3.9
+dependencies:
+  - path: /opt/lib
+  - requirements: /requirements.txt
+  - numpy
+`,
+			want: []Diagnostic{
+				{Line: 4, Column: 11, Message: "local path can't be absolute, has to be relative, found: /opt/lib"},
+				{Line: 5, Column: 19, Message: "requirements path can't be absolute, has to be relative, found: /requirements.txt"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lint([]byte(tt.mopyfile))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	d := Diagnostic{Line: 3, Column: 5, Message: "unknown key pips"}
+	if got, want := d.String(), "3:5: unknown key pips"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestLintUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		mopyfile string
+		want     []Diagnostic
+	}{
+		{
+			name: "typo",
+			mopyfile: `apiVersion: v1
+python: 3.9
+pips:
+  - numpy
+`,
+			want: []Diagnostic{{Line: 3, Column: 1, Message: "unknown key pips, did you mean pip?"}},
+		},
+		{
+			name: "underscore",
+			mopyfile: `apiVersion: v1
+python: 3.9
+build_deps: [ libpq-dev ]
+`,
+			want: []Diagnostic{{Line: 3, Column: 1, Message: "unknown key build_deps, did you mean build-deps?"}},
+		},
+		{
+			name: "no suggestion",
+			mopyfile: `apiVersion: v1
+python: 3.9
+maintainer: me
+`,
+			want: []Diagnostic{{Line: 3, Column: 1, Message: "unknown key maintainer"}},
+		},
+		{
+			name: "nested",
+			mopyfile: `apiVersion: v1
+python: 3.9
+indices:
+  - url: https://mirror.company.org/simple
+    weight: 10
+targets:
+  api:
+    modul: api
+`,
+			want: []Diagnostic{
+				{Line: 5, Column: 5, Message: "unknown key weight"},
+				{Line: 8, Column: 5, Message: "unknown key modul, did you mean module?"},
+			},
+		},
+		{
+			name: "v2",
+			mopyfile: `apiVersion: v2
+python: 3.9
+runtime:
+  modul: app
+dependencies:
+  - packge: numpy
+`,
+			want: []Diagnostic{
+				{Line: 4, Column: 3, Message: "unknown key modul, did you mean module?"},
+				{Line: 6, Column: 5, Message: "unknown key packge, did you mean package?"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lint([]byte(tt.mopyfile))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"pip", "pip", 0},
+		{"pips", "pip", 1},
+		{"modlue", "module", 2},
+		{"", "cmd", 3},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, tt := range tests {
+		if got := distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("distance(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	c, err := NewFromBytes([]byte(`apiVersion: v1
+python: 3.9
+pips:
+  - numpy
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Diagnostic{{Line: 3, Column: 1, Message: "unknown key pips, did you mean pip?"}}
+	if !reflect.DeepEqual(c.Warnings, want) {
+		t.Errorf("Warnings = %v, want %v", c.Warnings, want)
+	}
+	if err := c.Strict(); err == nil {
+		t.Error("expected unknown keys to fail in strict mode")
+	}
+
+	c, err = NewFromBytes([]byte(`apiVersion: v1
+python: 3.9
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Strict(); err != nil {
+		t.Errorf("Strict() = %v, want no error", err)
+	}
+}
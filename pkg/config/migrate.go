@@ -0,0 +1,265 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var requirementPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)(\[([^\]]*)\])?\s*(.*)$`)
+
+// buildKeys and runtimeKeys map the keys of v1 moved into the build and runtime section of v2 to their new name.
+var buildKeys = map[string]string{
+	"build-deps":     "deps",
+	"installer":      "installer",
+	"require-hashes": "require-hashes",
+}
+
+var runtimeKeys = map[string]string{
+	"runtime-deps": "deps",
+	"entrypoint":   "entrypoint",
+	"cmd":          "cmd",
+	"module":       "module",
+	"script":       "script",
+	"expose":       "expose",
+	"volumes":      "volumes",
+	"healthcheck":  "healthcheck",
+	"stop-signal":  "stop-signal",
+	"workdir":      "workdir",
+	"user":         "user",
+}
+
+// Migrate rewrites the Mopyfile b of apiVersion v1 as v2. The yaml nodes are moved instead of decoded, so comments
+// stay with the keys and values they belong to.
+func Migrate(b []byte) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config")
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("the Mopyfile has to be a mapping")
+	}
+	doc := root.Content[0]
+
+	if version := apiVersionOf(doc); version != "" && version != apiVersionV1 {
+		return nil, fmt.Errorf("only Mopyfiles of version %s can be migrated, found: %s", apiVersionV1, version)
+	}
+
+	build := &yaml.Node{Kind: yaml.MappingNode}
+	runtime := &yaml.Node{Kind: yaml.MappingNode}
+	var content []*yaml.Node
+
+	// the sections take the place of the first key moved into them
+	section := func(name string, node *yaml.Node) {
+		if len(node.Content) == 0 {
+			content = append(content, scalar(name), node)
+		}
+	}
+
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+
+		if name, ok := buildKeys[key.Value]; ok {
+			section("build", build)
+			key.Value = name
+			build.Content = append(build.Content, key, value)
+			continue
+		}
+		if name, ok := runtimeKeys[key.Value]; ok {
+			section("runtime", runtime)
+			key.Value = name
+			runtime.Content = append(runtime.Content, key, value)
+			continue
+		}
+
+		switch key.Value {
+		case "apiVersion":
+			value.Value = apiVersionV2
+			value.Tag = "!!str"
+			content = append(content, key, value)
+
+		case "base":
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				baseKey, baseValue := value.Content[j], value.Content[j+1]
+				target := build
+				if baseKey.Value == "runtime" {
+					section("runtime", runtime)
+					target = runtime
+				} else {
+					section("build", build)
+				}
+				if j == 0 {
+					baseKey.HeadComment = joinComments(key.HeadComment, baseKey.HeadComment)
+				}
+				baseKey.Value = "base"
+				target.Content = append(target.Content, baseKey, baseValue)
+			}
+
+		case "pip":
+			key.Value = "dependencies"
+			if err := migrateDependencies(value); err != nil {
+				return nil, err
+			}
+			content = append(content, key, value)
+
+		case "targets":
+			for j := 1; j < len(value.Content); j += 2 {
+				target := value.Content[j]
+				for k := 0; k+1 < len(target.Content); k += 2 {
+					if target.Content[k].Value != "pip" {
+						continue
+					}
+					target.Content[k].Value = "dependencies"
+					if err := migrateDependencies(target.Content[k+1]); err != nil {
+						return nil, errors.Wrapf(err, "target %s", value.Content[j-1].Value)
+					}
+				}
+			}
+			content = append(content, key, value)
+
+		default:
+			content = append(content, key, value)
+		}
+	}
+
+	if apiVersionOf(doc) == "" {
+		apiVersion := scalar("apiVersion")
+		// a comment above the first key belongs to the file
+		if len(content) > 0 {
+			apiVersion.HeadComment, content[0].HeadComment = content[0].HeadComment, ""
+		}
+		content = append([]*yaml.Node{apiVersion, scalar(apiVersionV2)}, content...)
+	}
+	doc.Content = content
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, errors.Wrap(err, "marshal config")
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, errors.Wrap(err, "marshal config")
+	}
+
+	// the result has to be a valid v2 Mopyfile
+	if _, err := Parse(buf.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "migrated Mopyfile is invalid")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// migrateDependencies replaces the pip strings of the sequence node with dependency objects in flow style, keeping
+// their comments.
+func migrateDependencies(dependencies *yaml.Node) error {
+	for i, node := range dependencies.Content {
+		if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("pip dependency %d has to be a string", i+1)
+		}
+
+		dependency := &yaml.Node{
+			Kind:        yaml.MappingNode,
+			Style:       yaml.FlowStyle,
+			HeadComment: node.HeadComment,
+			LineComment: node.LineComment,
+			FootComment: node.FootComment,
+		}
+		for _, field := range dependencyFields(node.Value) {
+			dependency.Content = append(dependency.Content, field[0], field[1])
+		}
+		dependencies.Content[i] = dependency
+	}
+
+	return nil
+}
+
+// dependencyFields splits the pip requirement into the fields of a Dependency.
+func dependencyFields(requirement string) [][2]*yaml.Node {
+	switch {
+	case strings.HasPrefix(requirement, "./") && strings.HasSuffix(requirement, "/requirements.txt"):
+		return [][2]*yaml.Node{{scalar("requirements"), scalar(requirement)}}
+
+	case strings.HasPrefix(requirement, "./"):
+		return [][2]*yaml.Node{{scalar("path"), scalar(requirement)}}
+
+	case strings.HasPrefix(requirement, "git+"):
+		repository, ref := splitGitRef(strings.TrimPrefix(requirement, "git+"))
+		fields := [][2]*yaml.Node{{scalar("git"), scalar(repository)}}
+		if ref != "" {
+			fields = append(fields, [2]*yaml.Node{scalar("ref"), scalar(ref)})
+		}
+		return fields
+
+	case httpPattern.MatchString(requirement):
+		return [][2]*yaml.Node{{scalar("url"), scalar(requirement)}}
+	}
+
+	// hashes are appended as --hash=sha256:... options
+	var hashes []*yaml.Node
+	if pos := strings.Index(requirement, "--hash="); pos != -1 {
+		for _, option := range strings.Fields(requirement[pos:]) {
+			hashes = append(hashes, scalar(strings.TrimPrefix(option, "--hash=")))
+		}
+		requirement = strings.TrimSpace(requirement[:pos])
+	}
+
+	match := requirementPattern.FindStringSubmatch(requirement)
+	if match == nil {
+		return [][2]*yaml.Node{{scalar("package"), scalar(requirement)}}
+	}
+
+	fields := [][2]*yaml.Node{{scalar("package"), scalar(match[1])}}
+	if match[3] != "" {
+		extras := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, extra := range strings.Split(match[3], ",") {
+			extras.Content = append(extras.Content, scalar(strings.TrimSpace(extra)))
+		}
+		fields = append(fields, [2]*yaml.Node{scalar("extras"), extras})
+	}
+	if match[4] != "" {
+		fields = append(fields, [2]*yaml.Node{scalar("version"), scalar(match[4])})
+	}
+	if len(hashes) > 0 {
+		fields = append(fields, [2]*yaml.Node{scalar("hashes"), {Kind: yaml.SequenceNode, Content: hashes}})
+	}
+
+	return fields
+}
+
+// splitGitRef splits the branch, tag or commit following the last @ of the path from the repository url.
+func splitGitRef(repository string) (string, string) {
+	pathStart := 0
+	if scheme := strings.Index(repository, "://"); scheme != -1 {
+		pathStart = scheme + 3
+		if slash := strings.Index(repository[pathStart:], "/"); slash != -1 {
+			pathStart += slash
+		}
+	}
+
+	at := strings.LastIndex(repository[pathStart:], "@")
+	if at == -1 {
+		return repository, ""
+	}
+
+	return repository[:pathStart+at], repository[pathStart+at+1:]
+}
+
+func scalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func joinComments(comments ...string) string {
+	var joined []string
+	for _, comment := range comments {
+		if comment != "" {
+			joined = append(joined, comment)
+		}
+	}
+
+	return strings.Join(joined, "\n")
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+var defaultPoetryGroups = []string{"main"}
+
+var packageNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// Poetry references a poetry.lock. Its packages are installed with their exact versions and hashes.
+type Poetry struct {
+	Lock   string   `yaml:"lock" required:"true" description:"Relative path to the poetry.lock."`
+	Groups []string `default:"main" yaml:"groups" description:"Dependency groups to install."`
+
+	// Packages are read from the poetry.lock by Load.
+	Packages []LockedPackage `yaml:"-"`
+}
+
+// LockedPackage is a single package pinned in a poetry.lock.
+type LockedPackage struct {
+	Name    string
+	Version string
+	Markers string
+	Hashes  []string
+}
+
+// poetryProject is the part of the pyproject.toml declaring the direct dependencies of the groups.
+type poetryProject struct {
+	Tool struct {
+		Poetry struct {
+			Dependencies    map[string]any `toml:"dependencies"`
+			DevDependencies map[string]any `toml:"dev-dependencies"`
+			Group           map[string]struct {
+				Dependencies map[string]any `toml:"dependencies"`
+			} `toml:"group"`
+		} `toml:"poetry"`
+	} `toml:"tool"`
+}
+
+type poetryLock struct {
+	Package []struct {
+		Name     string   `toml:"name"`
+		Version  string   `toml:"version"`
+		Optional bool     `toml:"optional"`
+		Category string   `toml:"category"`
+		Groups   []string `toml:"groups"`
+		Markers  any      `toml:"markers"`
+		// Dependencies are only read by their name, to resolve the groups of lock files without group information.
+		Dependencies map[string]any `toml:"dependencies"`
+		Files        []struct {
+			File string `toml:"file"`
+			Hash string `toml:"hash"`
+		} `toml:"files"`
+		Source struct {
+			Type string `toml:"type"`
+			Url  string `toml:"url"`
+		} `toml:"source"`
+	} `toml:"package"`
+}
+
+// UnmarshalYAML allows the short form `poetry: ./poetry.lock` next to the full object.
+func (p *Poetry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&p.Lock)
+	}
+
+	type plain Poetry
+	return node.Decode((*plain)(p))
+}
+
+// File returns the path of the poetry.lock relative to the build context.
+func (p *Poetry) File() string {
+	return path.Clean(p.Lock)
+}
+
+// PyprojectFile returns the path of the pyproject.toml next to the poetry.lock relative to the build context.
+func (p *Poetry) PyprojectFile() string {
+	return path.Join(path.Dir(p.File()), "pyproject.toml")
+}
+
+// Load reads the packages of the selected groups from the poetry.lock. Lock files written by poetry 1.5 to 1.8 carry no
+// group information, their packages are assigned to the groups by the dependencies declared in the pyproject.toml,
+// which is only read through pyproject for them.
+func (p *Poetry) Load(b []byte, pyproject func() ([]byte, error)) error {
+	var lock poetryLock
+	if err := toml.Unmarshal(b, &lock); err != nil {
+		return errors.Wrap(err, "unmarshal poetry.lock")
+	}
+
+	groups := p.Groups
+	if len(groups) == 0 {
+		groups = defaultPoetryGroups
+	}
+
+	var selected map[string]bool
+	if !lock.hasGroups() {
+		b, err := pyproject()
+		if err != nil {
+			return errors.Wrapf(err, "%s has no dependency groups, reading %s", p.File(), p.PyprojectFile())
+		}
+		if selected, err = lock.reachable(b, groups); err != nil {
+			return errors.Wrapf(err, "resolving the groups of %s", p.File())
+		}
+	}
+
+	p.Packages = nil
+	for _, pkg := range lock.Package {
+		packageGroups := pkg.Groups
+		if pkg.Category != "" {
+			packageGroups = []string{pkg.Category}
+		}
+		if selected != nil {
+			if !selected[normalizedName(pkg.Name)] {
+				continue
+			}
+		} else if !containsAny(packageGroups, groups) {
+			continue
+		}
+		if pkg.Optional {
+			continue
+		}
+
+		switch pkg.Source.Type {
+		case "", "legacy":
+		default:
+			return fmt.Errorf("package %s is locked from a %s source, only index packages can be installed from %s", pkg.Name, pkg.Source.Type, p.File())
+		}
+
+		if len(pkg.Files) == 0 {
+			return fmt.Errorf("package %s has no hashes in %s", pkg.Name, p.File())
+		}
+
+		locked := LockedPackage{Name: pkg.Name, Version: pkg.Version}
+		for _, file := range pkg.Files {
+			locked.Hashes = append(locked.Hashes, file.Hash)
+		}
+
+		// poetry 2 writes the markers per group
+		switch markers := pkg.Markers.(type) {
+		case string:
+			locked.Markers = markers
+		case map[string]any:
+			for _, group := range groups {
+				if groupMarkers, ok := markers[group].(string); ok {
+					locked.Markers = groupMarkers
+					break
+				}
+			}
+		}
+
+		p.Packages = append(p.Packages, locked)
+	}
+
+	return nil
+}
+
+// hasGroups reports if the packages of the lock file carry their groups, as written by poetry before 1.5 and since 2.0.
+func (l *poetryLock) hasGroups() bool {
+	for _, pkg := range l.Package {
+		if pkg.Category != "" || len(pkg.Groups) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reachable returns the normalized names of the locked packages required by the groups of the pyproject.toml b,
+// directly or transitively.
+func (l *poetryLock) reachable(b []byte, groups []string) (map[string]bool, error) {
+	var project poetryProject
+	if err := toml.Unmarshal(b, &project); err != nil {
+		return nil, errors.Wrap(err, "unmarshal pyproject.toml")
+	}
+
+	declared := map[string]map[string]any{"dev": project.Tool.Poetry.DevDependencies}
+	for name, group := range project.Tool.Poetry.Group {
+		declared[name] = group.Dependencies
+	}
+	declared["main"] = project.Tool.Poetry.Dependencies
+
+	dependencies := map[string][]string{}
+	for _, pkg := range l.Package {
+		name := normalizedName(pkg.Name)
+		for dependency := range pkg.Dependencies {
+			dependencies[name] = append(dependencies[name], normalizedName(dependency))
+		}
+	}
+
+	var queue []string
+	for _, group := range groups {
+		if _, ok := declared[group]; !ok {
+			return nil, fmt.Errorf("group %s isn't declared in the pyproject.toml", group)
+		}
+		for dependency := range declared[group] {
+			if dependency != "python" {
+				queue = append(queue, normalizedName(dependency))
+			}
+		}
+	}
+
+	selected := map[string]bool{}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if selected[name] {
+			continue
+		}
+		selected[name] = true
+		queue = append(queue, dependencies[name]...)
+	}
+
+	return selected, nil
+}
+
+// normalizedName normalizes a package name as defined by PEP 503, so names are compared regardless of their spelling.
+func normalizedName(name string) string {
+	return packageNameSeparators.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// Requirements renders the locked packages as a hash pinned requirements.txt.
+func (p *Poetry) Requirements() string {
+	var lines []string
+
+	for _, pkg := range p.Packages {
+		line := fmt.Sprintf("%s==%s", pkg.Name, pkg.Version)
+		if pkg.Markers != "" {
+			line += " ; " + pkg.Markers
+		}
+		for _, hash := range pkg.Hashes {
+			line += " --hash=" + hash
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (p *Poetry) validate() error {
+	if p.Lock == "" {
+		return errors.New("poetry lock path can't be empty")
+	}
+	if strings.HasPrefix(p.Lock, "/") {
+		return fmt.Errorf("poetry lock path can't be absolute, has to be relative, found: %s", p.Lock)
+	}
+
+	for _, group := range p.Groups {
+		if strings.TrimSpace(group) == "" {
+			return errors.New("poetry groups can't be empty")
+		}
+	}
+
+	return nil
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, candidate := range candidates {
+		if slices.Contains(values, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const poetryLockWithoutGroups = `[[package]]
+name = "certifi"
+version = "2024.2.2"
+optional = false
+files = [{file = "certifi-2024.2.2.tar.gz", hash = "sha256:aa"}]
+
+[[package]]
+name = "colorama"
+version = "0.4.6"
+optional = false
+files = [{file = "colorama-0.4.6.tar.gz", hash = "sha256:bb"}]
+
+[[package]]
+name = "pytest"
+version = "8.1.1"
+optional = false
+files = [{file = "pytest-8.1.1.tar.gz", hash = "sha256:cc"}]
+
+[package.dependencies]
+colorama = {version = "*", markers = "sys_platform == \"win32\""}
+iniconfig = "*"
+
+[[package]]
+name = "iniconfig"
+version = "2.0.0"
+optional = false
+files = [{file = "iniconfig-2.0.0.tar.gz", hash = "sha256:dd"}]
+
+[[package]]
+name = "Typing_Extensions"
+version = "4.10.0"
+optional = false
+files = [{file = "typing_extensions-4.10.0.tar.gz", hash = "sha256:ee"}]
+`
+
+const poetryPyproject = `[tool.poetry.dependencies]
+python = "^3.11"
+certifi = "^2024.2.2"
+
+[tool.poetry.dev-dependencies]
+typing-extensions = "^4.10"
+
+[tool.poetry.group.test.dependencies]
+pytest = "^8.1"
+`
+
+const poetryLockWithGroups = `[[package]]
+name = "certifi"
+version = "2024.2.2"
+optional = false
+groups = ["main"]
+files = [{file = "certifi-2024.2.2.tar.gz", hash = "sha256:aa"}]
+
+[[package]]
+name = "pytest"
+version = "8.1.1"
+optional = false
+groups = ["test"]
+files = [{file = "pytest-8.1.1.tar.gz", hash = "sha256:cc"}]
+`
+
+func TestPoetryLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		lock      string
+		pyproject string
+		groups    []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "groups of the lock", lock: poetryLockWithGroups, groups: []string{"test"}, want: []string{"pytest"}},
+		{name: "default group of the lock", lock: poetryLockWithGroups, want: []string{"certifi"}},
+		{name: "main of the pyproject", lock: poetryLockWithoutGroups, pyproject: poetryPyproject, want: []string{"certifi"}},
+		{
+			name:      "transitive dependencies",
+			lock:      poetryLockWithoutGroups,
+			pyproject: poetryPyproject,
+			groups:    []string{"main", "test"},
+			want:      []string{"certifi", "colorama", "pytest", "iniconfig"},
+		},
+		{name: "dev dependencies", lock: poetryLockWithoutGroups, pyproject: poetryPyproject, groups: []string{"dev"}, want: []string{"Typing_Extensions"}},
+		{name: "unknown group", lock: poetryLockWithoutGroups, pyproject: poetryPyproject, groups: []string{"docs"}, wantErr: true},
+		{name: "missing pyproject", lock: poetryLockWithoutGroups, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Poetry{Lock: "poetry.lock", Groups: tt.groups}
+			pyproject := func() ([]byte, error) {
+				if tt.pyproject == "" {
+					return nil, errors.New("not found")
+				}
+				return []byte(tt.pyproject), nil
+			}
+
+			err := p.Load([]byte(tt.lock), pyproject)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, pkg := range p.Packages {
+				got = append(got, pkg.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() packages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
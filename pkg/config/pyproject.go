@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const pyprojectFilename = "pyproject.toml"
+
+// Pyproject references a PEP 621 pyproject.toml. The project is installed together with the selected extras.
+type Pyproject struct {
+	Path   string   `yaml:"path" required:"true" description:"Relative path to the pyproject.toml or the folder containing it."`
+	Extras []string `yaml:"extras" description:"Optional dependency groups of the project to install alongside."`
+
+	// Name, Version and Dependencies are read from the pyproject.toml by Load.
+	Name         string   `yaml:"-"`
+	Version      string   `yaml:"-"`
+	Dependencies []string `yaml:"-"`
+}
+
+type pyprojectToml struct {
+	Project struct {
+		Name                 string              `toml:"name"`
+		Version              string              `toml:"version"`
+		Dependencies         []string            `toml:"dependencies"`
+		OptionalDependencies map[string][]string `toml:"optional-dependencies"`
+	} `toml:"project"`
+	Tool struct {
+		Poetry struct {
+			Name    string `toml:"name"`
+			Version string `toml:"version"`
+		} `toml:"poetry"`
+	} `toml:"tool"`
+}
+
+// UnmarshalYAML allows the short form `pyproject: ./path` next to the full object.
+func (p *Pyproject) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&p.Path)
+	}
+
+	type plain Pyproject
+	return node.Decode((*plain)(p))
+}
+
+// Dir returns the folder containing the pyproject.toml relative to the build context.
+func (p *Pyproject) Dir() string {
+	dir := path.Clean(p.Path)
+	if path.Base(dir) == pyprojectFilename {
+		dir = path.Dir(dir)
+	}
+	if dir == "." {
+		return "./"
+	}
+
+	return "./" + dir + "/"
+}
+
+// File returns the path of the pyproject.toml relative to the build context.
+func (p *Pyproject) File() string {
+	return path.Join(p.Dir(), pyprojectFilename)
+}
+
+// Load reads name, version and dependencies of the project including the ones of the selected extras.
+func (p *Pyproject) Load(b []byte) error {
+	var pyproject pyprojectToml
+	if err := toml.Unmarshal(b, &pyproject); err != nil {
+		return errors.Wrap(err, "unmarshal pyproject.toml")
+	}
+
+	p.Name = pyproject.Project.Name
+	p.Version = pyproject.Project.Version
+
+	// poetry projects before poetry 2 declare their metadata in [tool.poetry]
+	if p.Name == "" {
+		p.Name = pyproject.Tool.Poetry.Name
+		p.Version = pyproject.Tool.Poetry.Version
+	}
+
+	if p.Name == "" {
+		return fmt.Errorf("%s has no [project] table with a name", p.File())
+	}
+	p.Dependencies = pyproject.Project.Dependencies
+
+	for _, extra := range p.Extras {
+		dependencies, ok := pyproject.Project.OptionalDependencies[extra]
+		if !ok {
+			return fmt.Errorf("extra %s is not declared in %s", extra, p.File())
+		}
+		p.Dependencies = append(p.Dependencies, dependencies...)
+	}
+
+	return nil
+}
+
+func (p *Pyproject) validate() error {
+	if p.Path == "" {
+		return errors.New("pyproject path can't be empty")
+	}
+	if strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("pyproject path can't be absolute, has to be relative, found: %s", p.Path)
+	}
+
+	for _, extra := range p.Extras {
+		if strings.TrimSpace(extra) == "" {
+			return errors.New("pyproject extras can't be empty")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run ../../cmd/mopy schema ../../json-schema.json
+//go:generate go run ../../cmd/mopy schema -version v2 ../../json-schema-v2.json
+
+const absolutePathPattern = "^/"
+const hashPattern = "^sha256:[0-9a-fA-F]{64}$"
+
+// durationPattern matches the durations accepted by time.ParseDuration.
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// schema is the subset of JSON Schema draft-07 used to describe the Mopyfile.
+type schema struct {
+	Schema               string    `json:"$schema,omitempty"`
+	Ref                  string    `json:"$ref,omitempty"`
+	Title                string    `json:"title,omitempty"`
+	Description          string    `json:"description,omitempty"`
+	Type                 string    `json:"type,omitempty"`
+	Format               string    `json:"format,omitempty"`
+	Pattern              string    `json:"pattern,omitempty"`
+	Enum                 []any     `json:"enum,omitempty"`
+	Minimum              *int      `json:"minimum,omitempty"`
+	MinItems             int       `json:"minItems,omitempty"`
+	Items                *schema   `json:"items,omitempty"`
+	OneOf                []*schema `json:"oneOf,omitempty"`
+	Properties           *ordered  `json:"properties,omitempty"`
+	PropertyNames        *schema   `json:"propertyNames,omitempty"`
+	Required             []string  `json:"required,omitempty"`
+	AdditionalProperties any       `json:"additionalProperties,omitempty"`
+	Default              any       `json:"default,omitempty"`
+	Definitions          *ordered  `json:"definitions,omitempty"`
+}
+
+// ordered is a JSON object keeping the order its keys were added in.
+type ordered struct {
+	keys   []string
+	values map[string]*schema
+}
+
+func (o *ordered) set(key string, value *schema) {
+	if o.values == nil {
+		o.values = map[string]*schema{}
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *ordered) has(key string) bool {
+	_, ok := o.values[key]
+	return ok
+}
+
+func (o *ordered) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// schemaRules are the checks of Validate expressed in JSON Schema, keyed by the config type and its yaml key. The
+// entries without a key describe the type itself.
+var schemaRules = map[string]schema{
+	"Config": {
+		Title:       "Mopyfile",
+		Description: "Configuration for building Python-based container images using Mopy.",
+	},
+	"Config.apiVersion": {Enum: enum([]string{apiVersionV1})},
+	"Config.python":     {Pattern: pythonVersionPattern.String()},
+	"Config.build-deps": {Items: &schema{Description: "Name of the apt package."}},
+	"Config.pip": {Items: &schema{
+		Description: "A pip dependency string (e.g., 'numpy==1.22', 'git+https://...', './local-package', './requirements.txt').",
+	}},
+	"Config.installer": {Enum: enum(installers)},
+	"Config.module":    {Pattern: modulePattern.String()},
+	"Config.script":    {Pattern: scriptPattern.String()},
+	"Config.expose":    {Items: &schema{Pattern: portPattern.String()}},
+	"Config.volumes":   {Items: &schema{Pattern: absolutePathPattern}},
+	"Config.workdir":   {Pattern: absolutePathPattern},
+	"Config.targets":   {PropertyNames: &schema{Pattern: targetNamePattern.String()}},
+
+	"ConfigV2": {
+		Title:       "Mopyfile v2",
+		Description: "Configuration for building Python-based container images using Mopy.",
+	},
+	"ConfigV2.apiVersion": {Enum: enum([]string{apiVersionV2})},
+	"ConfigV2.python":     {Pattern: pythonVersionPattern.String()},
+	"ConfigV2.targets":    {PropertyNames: &schema{Pattern: targetNamePattern.String()}},
+
+	"Build":           {Description: "Settings of the build stage the dependencies are installed in."},
+	"Build.deps":      {Items: &schema{Description: "Name of the apt package."}},
+	"Build.installer": {Enum: enum(installers)},
+
+	"Runtime":         {Description: "Settings of the final image."},
+	"Runtime.module":  {Pattern: modulePattern.String()},
+	"Runtime.script":  {Pattern: scriptPattern.String()},
+	"Runtime.expose":  {Items: &schema{Pattern: portPattern.String()}},
+	"Runtime.volumes": {Items: &schema{Pattern: absolutePathPattern}},
+	"Runtime.workdir": {Pattern: absolutePathPattern},
+
+	"Dependency":        {Description: "A dependency, exactly one of package, git, url, path and requirements is required."},
+	"Dependency.hashes": {Items: &schema{Pattern: hashPattern}},
+
+	"TargetV2":        {Description: "Overrides of a named image."},
+	"TargetV2.module": {Pattern: modulePattern.String()},
+	"TargetV2.script": {Pattern: scriptPattern.String()},
+
+	"Index":        {Description: "Configuration for an additional pip index."},
+	"Index.url":    {Format: "uri"},
+	"Index.secret": {Pattern: secretIdPattern.String()},
+
+	"Pyproject": {Description: "A PEP 621 project to install."},
+	"Poetry":    {Description: "A poetry.lock to install."},
+	"Base":      {Description: "Overrides the base images of the build stages."},
+
+	"Healthcheck":         {Description: "Checks whether the container is healthy."},
+	"Healthcheck.command": {MinItems: 1},
+	"Healthcheck.retries": {Minimum: minimum(0)},
+
+	"User":      {Description: "Non-root user the final image runs as."},
+	"User.name": {Pattern: userNamePattern.String()},
+	"User.uid":  {Minimum: minimum(1)},
+	"User.gid":  {Minimum: minimum(0)},
+	"User.home": {Pattern: absolutePathPattern},
+
+	"Target":        {Description: "Overrides of a named image."},
+	"Target.module": {Pattern: modulePattern.String()},
+	"Target.script": {Pattern: scriptPattern.String()},
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// Schema returns the JSON Schema of the Mopyfile of apiVersion. It is generated from the yaml, default, required and
+// description tags of the config types and the rules of Validate, json-schema.json must not be edited by hand.
+func Schema(apiVersion string) ([]byte, error) {
+	if !slices.Contains(apiVersions, apiVersion) {
+		return nil, fmt.Errorf("unknown version %s. Known versions: %s", apiVersion, quoted(apiVersions))
+	}
+
+	g := schemaGenerator{}
+	s := g.object(configType(apiVersion))
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Definitions = &g.definitions
+
+	b, err := marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+
+	return out.Bytes(), nil
+}
+
+type schemaGenerator struct {
+	definitions ordered
+}
+
+// object returns the schema of the struct t. Only fields with a yaml key are part of it.
+func (g *schemaGenerator) object(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: &ordered{}, AdditionalProperties: false}
+	rule := schemaRules[t.Name()]
+	s.Title = rule.Title
+	s.Description = rule.Description
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		s.Properties.set(name, g.property(t, name, field))
+		if field.Tag.Get("required") == "true" {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return s
+}
+
+func (g *schemaGenerator) property(parent reflect.Type, name string, field reflect.StructField) *schema {
+	s := g.typeOf(field.Type)
+	// siblings of $ref are ignored, the referenced definition is described instead
+	if s.Ref != "" {
+		return s
+	}
+
+	s.Description = field.Tag.Get("description")
+	if value, ok := field.Tag.Lookup("default"); ok {
+		s.Default = defaultValue(field.Type, value)
+	}
+
+	rule := schemaRules[parent.Name()+"."+name]
+	s.Format = rule.Format
+	if rule.Pattern != "" {
+		s.Pattern = rule.Pattern
+	}
+	s.Enum = rule.Enum
+	s.Minimum = rule.Minimum
+	s.MinItems = rule.MinItems
+	s.PropertyNames = rule.PropertyNames
+	if rule.Items != nil {
+		s.Items.Description = rule.Items.Description
+		s.Items.Pattern = rule.Items.Pattern
+	}
+
+	return s
+}
+
+func (g *schemaGenerator) typeOf(t reflect.Type) *schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		return &schema{Type: "string", Pattern: durationPattern}
+	case t.Kind() == reflect.Struct:
+		return g.definition(t)
+	case t.Kind() == reflect.Slice:
+		return &schema{Type: "array", Items: g.typeOf(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: g.typeOf(t.Elem())}
+	case t.Kind() == reflect.Bool:
+		return &schema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &schema{Type: "integer"}
+	default:
+		return &schema{Type: "string"}
+	}
+}
+
+// definition adds the struct t to the definitions and returns a reference to it. Types with their own UnmarshalYAML
+// accept a short form, the string sets their first field.
+func (g *schemaGenerator) definition(t reflect.Type) *schema {
+	// the types of v2 replacing the ones of v1 are described by the same name
+	name := strings.ToLower(strings.TrimSuffix(t.Name(), "V2"))
+	if !g.definitions.has(name) {
+		g.definitions.set(name, nil)
+		g.definitions.set(name, g.object(t))
+	}
+
+	ref := &schema{Ref: "#/definitions/" + name}
+	if !reflect.PointerTo(t).Implements(unmarshalerType) {
+		return ref
+	}
+
+	short := &schema{Type: "string", Description: t.Field(0).Tag.Get("description")}
+	return &schema{OneOf: []*schema{short, ref}}
+}
+
+// defaultValue converts the default tag to the JSON type of t. Lists are separated by commas.
+func defaultValue(t reflect.Type, value string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(value)
+		return b
+	case reflect.Int:
+		i, _ := strconv.Atoi(value)
+		return i
+	case reflect.Slice:
+		return enum(strings.Split(value, ","))
+	default:
+		return value
+	}
+}
+
+func enum(values []string) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+
+	return result
+}
+
+func minimum(i int) *int {
+	return &i
+}
+
+// marshal encodes v as JSON without escaping HTML characters like < in the descriptions.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
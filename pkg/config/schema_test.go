@@ -0,0 +1,38 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestSchemaIsUpToDate(t *testing.T) {
+	files := map[string]string{
+		apiVersionV1: "../../json-schema.json",
+		apiVersionV2: "../../json-schema-v2.json",
+	}
+
+	for version, file := range files {
+		t.Run(version, func(t *testing.T) {
+			generated, err := Schema(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			committed, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(generated, committed) {
+				t.Errorf("%s is outdated, regenerate it with go generate ./pkg/config", file)
+			}
+		})
+	}
+}
+
+func TestSchemaUnknownVersion(t *testing.T) {
+	if _, err := Schema("v3"); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
+)
+
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Target is a named image built from the same Mopyfile. Its settings override the ones of the Mopyfile, its pip
+// dependencies are installed on top of the common ones, so all targets share the common dependency layer.
+type Target struct {
+	Project    string            `yaml:"project" description:"Replaces project."`
+	Entrypoint []string          `yaml:"entrypoint" description:"Entrypoint of the final image. Can't be combined with module or script."`
+	Cmd        []string          `yaml:"cmd" description:"Arguments passed to the entrypoint of the final image."`
+	Module     string            `yaml:"module" description:"Python module run with python -m. Can't be combined with entrypoint or script."`
+	Script     string            `yaml:"script" description:"Console script installed by pip to run. Can't be combined with entrypoint or module."`
+	Pip        []string          `yaml:"pip" description:"Pip dependencies installed in addition to the common ones."`
+	Envs       map[string]string `yaml:"envs" description:"Environment variables added to the final image."`
+}
+
+// ForTarget returns the config of the target name. An empty name selects the Mopyfile itself.
+func (c *Config) ForTarget(name string) (*Config, error) {
+	if name == "" {
+		return c, nil
+	}
+
+	target, ok := c.Targets[name]
+	if !ok {
+		if len(c.Targets) == 0 {
+			return nil, fmt.Errorf("unknown target %s, the Mopyfile doesn't declare targets", name)
+		}
+		names := maps.Keys(c.Targets)
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown target %s. Known targets: %s", name, strings.Join(names, ", "))
+	}
+
+	t := *c
+	t.Targets = nil
+
+	if target.Project != "" {
+		t.Project = target.Project
+		if !strings.HasPrefix(t.Project, "./") {
+			t.Project = "./" + t.Project
+		}
+	}
+
+	// the way to start the image is replaced as a whole
+	if len(target.Entrypoint) > 0 || target.Module != "" || target.Script != "" {
+		t.Entrypoint = target.Entrypoint
+		t.Module = target.Module
+		t.Script = target.Script
+	}
+	if len(target.Cmd) > 0 {
+		t.Cmd = target.Cmd
+	}
+
+	t.TargetDependencies = target.Pip
+	t.TargetEnvs = target.Envs
+
+	return &t, nil
+}
+
+// TargetInstall returns a config containing only the pip dependencies of the selected target. They are installed
+// separately, after the common dependencies.
+func (c *Config) TargetInstall() *Config {
+	t := *c
+	t.PipDependencies = c.TargetDependencies
+	t.TargetDependencies = nil
+	t.Pyproject = nil
+	t.Poetry = nil
+
+	return &t
+}
+
+func (c *Config) validateTargets() error {
+	names := maps.Keys(c.Targets)
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !targetNamePattern.MatchString(name) {
+			return fmt.Errorf("%s is not a valid target name", name)
+		}
+
+		target := c.Targets[name]
+		if strings.HasPrefix(target.Project, "/") {
+			return fmt.Errorf("project path of target %s can't be absolute, has to be relative, found: %s", name, target.Project)
+		}
+
+		t, err := c.ForTarget(name)
+		if err != nil {
+			return err
+		}
+		if err := t.validateEntrypoint(); err != nil {
+			return errors.Wrapf(err, "target %s", name)
+		}
+
+		install := t.TargetInstall()
+		if invalidPaths := install.dependenciesFilteredByPrefix("/"); len(invalidPaths) > 0 {
+			return fmt.Errorf("local paths of target %s can only be relative, found: %s", name, strings.Join(invalidPaths, ", "))
+		}
+		if install.RequireHashes {
+			if err := install.validateHashes(); err != nil {
+				return errors.Wrapf(err, "target %s", name)
+			}
+		}
+	}
+
+	return nil
+}
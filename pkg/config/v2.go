@@ -0,0 +1,257 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	apiVersionV1 = "v1"
+	apiVersionV2 = "v2"
+)
+
+// ConfigV2 is the Mopyfile of apiVersion v2. Dependencies are objects instead of pip strings and the settings of the
+// build stage and the final image are grouped in their own sections. It is converted into a Config when loaded, which
+// the build works on for both versions.
+type ConfigV2 struct {
+	ApiVersion    string              `yaml:"apiVersion" required:"true" description:"API version of the Mopyfile format."`
+	PythonVersion string              `yaml:"python" required:"true" description:"The Python interpreter version to use. Formats: '3', '3.9', or '3.9.1'."`
+	Build         *Build              `yaml:"build"`
+	Dependencies  []Dependency        `yaml:"dependencies" description:"Dependencies to install, either a pip requirement or an object."`
+	Indices       []Index             `yaml:"indices" description:"Additional list of pip indices to consider for installing dependencies."`
+	NoPypi        bool                `default:"false" yaml:"no-pypi" description:"Never consult PyPI. The primary index, or the first index if none is primary, replaces it."`
+	Pyproject     *Pyproject          `yaml:"pyproject" description:"Install a PEP 621 project from its pyproject.toml. Either the relative path or an object."`
+	Poetry        *Poetry             `yaml:"poetry" description:"Install the packages pinned in a poetry.lock. Either the relative path or an object."`
+	Project       string              `yaml:"project" description:"Relative path to a Python file or folder. If a folder, it must contain a 'main.py'. Sets the entrypoint for the final image if present."`
+	Envs          map[string]string   `yaml:"envs" description:"Additional environment variables. These are present in the build and in the run stage."`
+	Labels        map[string]string   `yaml:"labels" description:"Additional labels to add to the final image. These have precedence over automatically added labels. Placeholders like ${mopy.sbom} are supported."`
+	Sbom          *bool               `default:"true" yaml:"sbom" description:"Whether to add an SBOM (Software Bill of Materials) label containing pip dependencies to the image."`
+	Runtime       *Runtime            `yaml:"runtime"`
+	Targets       map[string]TargetV2 `yaml:"targets" description:"Named images built from this file, selected with the target option."`
+}
+
+// Build groups the settings of the build stage the dependencies are installed in.
+type Build struct {
+	Base          string   `yaml:"base" description:"Image the dependencies are installed in. Defaults to python:<version>, of the Debian release of a distroless runtime image."`
+	Deps          []string `yaml:"deps" description:"Additional 'apt' packages to install before starting the build. These are not part of the final image."`
+	Installer     string   `default:"pip" yaml:"installer" description:"Installer used to install the dependencies in the build stage."`
+	RequireHashes bool     `default:"false" yaml:"require-hashes" description:"Only allow package dependencies with an exact version and sha256 hashes, installed in pip's hash checking mode."`
+}
+
+// Runtime groups the settings of the final image.
+type Runtime struct {
+	Base        string       `yaml:"base" description:"Image of the final stage. Has to provide Python, and the configured user if it has no shell to create it with."`
+	Deps        []string     `yaml:"deps" description:"Additional apt packages installed into the final image. Forces a slim runtime image."`
+	Entrypoint  []string     `yaml:"entrypoint" description:"Entrypoint of the final image. Can't be combined with module or script."`
+	Cmd         []string     `yaml:"cmd" description:"Arguments passed to the entrypoint of the final image."`
+	Module      string       `yaml:"module" description:"Python module run with python -m. Can't be combined with entrypoint or script."`
+	Script      string       `yaml:"script" description:"Console script installed by pip to run. Can't be combined with entrypoint or module."`
+	Expose      []string     `yaml:"expose" description:"Ports to expose, like 8080 or 5353/udp."`
+	Volumes     []string     `yaml:"volumes" description:"Absolute paths declared as volumes."`
+	Healthcheck *Healthcheck `yaml:"healthcheck"`
+	StopSignal  string       `yaml:"stop-signal" description:"Signal sent to stop the container, like SIGINT or 2."`
+	Workdir     string       `yaml:"workdir" description:"Absolute working directory of the final image."`
+	User        *User        `yaml:"user"`
+}
+
+// TargetV2 is a Target of apiVersion v2, its dependencies are objects as well.
+type TargetV2 struct {
+	Project      string            `yaml:"project" description:"Replaces project."`
+	Entrypoint   []string          `yaml:"entrypoint" description:"Entrypoint of the final image. Can't be combined with module or script."`
+	Cmd          []string          `yaml:"cmd" description:"Arguments passed to the entrypoint of the final image."`
+	Module       string            `yaml:"module" description:"Python module run with python -m. Can't be combined with entrypoint or script."`
+	Script       string            `yaml:"script" description:"Console script installed by pip to run. Can't be combined with entrypoint or module."`
+	Dependencies []Dependency      `yaml:"dependencies" description:"Dependencies installed in addition to the common ones."`
+	Envs         map[string]string `yaml:"envs" description:"Environment variables added to the final image."`
+}
+
+// Dependency is a single dependency of apiVersion v2. Exactly one of package, git, url, path and requirements is set.
+type Dependency struct {
+	Package      string   `yaml:"package" description:"Name of a package from the indices. The short form takes any pip requirement, like numpy==1.22."`
+	Version      string   `yaml:"version" description:"Version specifier of the package, like ==1.22 or >=2,<3. A bare version like 1.22 is pinned with ==."`
+	Extras       []string `yaml:"extras" description:"Extras of the package to install alongside."`
+	Hashes       []string `yaml:"hashes" description:"Hashes of the package, like sha256:<hex>. Required by require-hashes."`
+	Git          string   `yaml:"git" description:"Url of a git repository, like https://github.com/org/repo.git or ssh://git@github.com/org/repo.git."`
+	Ref          string   `yaml:"ref" description:"Branch, tag or commit of the git repository."`
+	Url          string   `yaml:"url" description:"Url of a wheel or source archive."`
+	Path         string   `yaml:"path" description:"Relative path to a local package."`
+	Requirements string   `yaml:"requirements" description:"Relative path to a requirements.txt."`
+}
+
+// UnmarshalYAML allows the short form `- numpy==1.22` next to the full object.
+func (d *Dependency) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&d.Package)
+	}
+
+	type plain Dependency
+	return node.Decode((*plain)(d))
+}
+
+// Requirement returns the dependency as pip requirement, as used by apiVersion v1.
+func (d Dependency) Requirement() (string, error) {
+	kinds := 0
+	for _, value := range []string{d.Package, d.Git, d.Url, d.Path, d.Requirements} {
+		if value != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return "", fmt.Errorf("dependency needs exactly one of package, git, url, path or requirements, found %d", kinds)
+	}
+	if d.Package == "" && (d.Version != "" || len(d.Extras) > 0 || len(d.Hashes) > 0) {
+		return "", errors.New("version, extras and hashes are only allowed for packages")
+	}
+	if d.Git == "" && d.Ref != "" {
+		return "", fmt.Errorf("ref is only allowed for git dependencies, found: %s", d.Ref)
+	}
+
+	switch {
+	case d.Git != "":
+		requirement := "git+" + strings.TrimPrefix(d.Git, "git+")
+		if d.Ref != "" {
+			requirement += "@" + d.Ref
+		}
+		return requirement, nil
+
+	case d.Url != "":
+		return d.Url, nil
+
+	case d.Path != "":
+		return relative(d.Path), nil
+
+	case d.Requirements != "":
+		if path.Base(d.Requirements) != "requirements.txt" {
+			return "", fmt.Errorf("requirements has to point to a requirements.txt, found: %s", d.Requirements)
+		}
+		return relative(d.Requirements), nil
+	}
+
+	requirement := d.Package
+	if len(d.Extras) > 0 {
+		requirement += "[" + strings.Join(d.Extras, ",") + "]"
+	}
+	version, err := versionSpecifier(d.Version)
+	if err != nil {
+		return "", err
+	}
+	requirement += version
+	for _, hash := range d.Hashes {
+		requirement += " --hash=" + hash
+	}
+
+	return requirement, nil
+}
+
+// versionSpecifier returns the version as PEP 440 specifier, a bare version like 1.22 is pinned with ==.
+func versionSpecifier(version string) (string, error) {
+	version = strings.TrimSpace(version)
+	switch {
+	case version == "" || strings.ContainsAny(version[:1], "=<>!~"):
+		return version, nil
+	case version[0] >= '0' && version[0] <= '9':
+		return "==" + version, nil
+	default:
+		return "", fmt.Errorf("version has to be a version specifier like ==1.22 or >=2,<3, found: %s", version)
+	}
+}
+
+// relative prefixes the path with ./ like local paths of apiVersion v1 are written. Absolute paths are kept and
+// rejected by Validate.
+func relative(p string) string {
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, "./") {
+		return p
+	}
+
+	return "./" + p
+}
+
+// config converts the Mopyfile into the Config the build works on.
+func (c *ConfigV2) config() (*Config, error) {
+	dependencies, err := requirements(c.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := &Config{
+		ApiVersion:      c.ApiVersion,
+		PythonVersion:   c.PythonVersion,
+		Envs:            c.Envs,
+		Indices:         c.Indices,
+		PipDependencies: dependencies,
+		Project:         c.Project,
+		Pyproject:       c.Pyproject,
+		Poetry:          c.Poetry,
+		NoPypi:          c.NoPypi,
+		Labels:          c.Labels,
+		Sbom:            c.Sbom,
+	}
+
+	if build := c.Build; build != nil {
+		converted.Apt = build.Deps
+		converted.Installer = build.Installer
+		converted.RequireHashes = build.RequireHashes
+		if build.Base != "" {
+			converted.Base = &Base{Builder: build.Base}
+		}
+	}
+
+	if runtime := c.Runtime; runtime != nil {
+		converted.RuntimeDeps = runtime.Deps
+		converted.Entrypoint = runtime.Entrypoint
+		converted.Cmd = runtime.Cmd
+		converted.Module = runtime.Module
+		converted.Script = runtime.Script
+		converted.Expose = runtime.Expose
+		converted.Volumes = runtime.Volumes
+		converted.Healthcheck = runtime.Healthcheck
+		converted.StopSignal = runtime.StopSignal
+		converted.Workdir = runtime.Workdir
+		converted.User = runtime.User
+		if runtime.Base != "" {
+			if converted.Base == nil {
+				converted.Base = &Base{}
+			}
+			converted.Base.Runtime = runtime.Base
+		}
+	}
+
+	if len(c.Targets) > 0 {
+		converted.Targets = map[string]Target{}
+	}
+	for name, target := range c.Targets {
+		dependencies, err := requirements(target.Dependencies)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", name)
+		}
+		converted.Targets[name] = Target{
+			Project:    target.Project,
+			Entrypoint: target.Entrypoint,
+			Cmd:        target.Cmd,
+			Module:     target.Module,
+			Script:     target.Script,
+			Pip:        dependencies,
+			Envs:       target.Envs,
+		}
+	}
+
+	return converted, nil
+}
+
+func requirements(dependencies []Dependency) ([]string, error) {
+	var requirements []string
+
+	for i, dependency := range dependencies {
+		requirement, err := dependency.Requirement()
+		if err != nil {
+			return nil, errors.Wrapf(err, "dependency %d", i+1)
+		}
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
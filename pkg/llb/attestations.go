@@ -0,0 +1,186 @@
+package llb
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+	slsacommon "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/common"
+	slsa02 "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+	"github.com/moby/buildkit/client/llb"
+	sbomscan "github.com/moby/buildkit/frontend/attestations/sbom"
+	"github.com/moby/buildkit/frontend/dockerui"
+	gatewayclient "github.com/moby/buildkit/frontend/gateway/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/result"
+	"github.com/moby/buildkit/util/purl"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+const (
+	mopyBuilderId      = "https://gitlab.com/cmdjulian/mopy"
+	mopyBuildType      = "https://gitlab.com/cmdjulian/mopy/Mopyfile@v1"
+	provenanceFilename = "mopy-provenance.json"
+	pypiUrl            = "https://pypi.org/simple"
+)
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// attachSBOM scans the final image of a platform and attaches the resulting SPDX document as in-toto attestation. The
+// scanner lists the installed Python distributions with their versions besides the packages of the base image.
+func attachSBOM(ctx context.Context, c gatewayclient.Client, scanner sbomscan.Scanner, br *buildResult, res *gatewayclient.Result) error {
+	att, err := scanner(ctx, br.ExportPlatform.ID, *br.State, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to scan image for platform %s", br.ExportPlatform.ID)
+	}
+
+	attSolve, err := result.ConvertAttestation(&att, func(st *llb.State) (gatewayclient.Reference, error) {
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := c.Solve(ctx, gatewayclient.SolveRequest{Definition: def.ToPB()})
+		if err != nil {
+			return nil, err
+		}
+
+		return r.SingleRef()
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to solve sbom for platform %s", br.ExportPlatform.ID)
+	}
+
+	res.AddAttestation(br.ExportPlatform.ID, *attSolve)
+
+	return nil
+}
+
+// provenance lists the inputs of a platform's build that BuildKit can't see, as pip and uv fetch them at build time.
+type provenance struct {
+	Mopyfile       string
+	MopyfileDigest digest.Digest
+}
+
+// attachProvenance attaches a SLSA provenance listing the base images with their digests, the package indices without
+// credentials, the git dependencies and the Mopyfile. It complements the provenance recorded by BuildKit itself.
+func attachProvenance(ctx context.Context, c gatewayclient.Client, cfg *config.Config, prov provenance, br *buildResult, res *gatewayclient.Result) error {
+	materials, err := provenanceMaterials(cfg, prov, br)
+	if err != nil {
+		return errors.Wrapf(err, "failed to collect provenance materials for platform %s", br.ExportPlatform.ID)
+	}
+
+	predicate := slsa02.ProvenancePredicate{
+		Builder:   slsacommon.ProvenanceBuilder{ID: mopyBuilderId},
+		BuildType: mopyBuildType,
+		Invocation: slsa02.ProvenanceInvocation{
+			ConfigSource: slsa02.ConfigSource{
+				EntryPoint: prov.Mopyfile,
+				Digest:     slsacommon.DigestSet{prov.MopyfileDigest.Algorithm().String(): prov.MopyfileDigest.Encoded()},
+			},
+			Environment: map[string]string{"platform": br.ExportPlatform.ID},
+		},
+		Materials: materials,
+	}
+
+	dt, err := json.MarshalIndent(predicate, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal provenance")
+	}
+
+	st := llb.Scratch().File(llb.Mkfile(provenanceFilename, 0644, dt), dockerui.WithInternalName("create mopy provenance"))
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.Solve(ctx, gatewayclient.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return errors.Wrapf(err, "failed to solve provenance for platform %s", br.ExportPlatform.ID)
+	}
+
+	ref, err := r.SingleRef()
+	if err != nil {
+		return err
+	}
+
+	res.AddAttestation(br.ExportPlatform.ID, result.Attestation[gatewayclient.Reference]{
+		Kind: gatewaypb.AttestationKindInToto,
+		Ref:  ref,
+		Path: provenanceFilename,
+		InToto: result.InTotoAttestation{
+			PredicateType: slsa02.PredicateSLSAProvenance,
+		},
+	})
+
+	return nil
+}
+
+// provenanceMaterials lists the inputs of the build. The base images are recorded as pinned by the build, so the
+// provenance names exactly the images the platform was built from.
+func provenanceMaterials(cfg *config.Config, prov provenance, br *buildResult) ([]slsacommon.ProvenanceMaterial, error) {
+	var materials []slsacommon.ProvenanceMaterial
+
+	p := br.ExportPlatform.Platform
+	for _, ref := range br.BaseImages {
+		uri, err := purl.RefToPURL("docker", ref, &p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert %s to package url", ref)
+		}
+
+		material := slsacommon.ProvenanceMaterial{URI: uri}
+		if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+			if canonical, ok := named.(reference.Canonical); ok {
+				dgst := canonical.Digest()
+				material.Digest = slsacommon.DigestSet{dgst.Algorithm().String(): dgst.Encoded()}
+			}
+		}
+		materials = append(materials, material)
+	}
+
+	for _, index := range indexUrls(cfg) {
+		materials = append(materials, slsacommon.ProvenanceMaterial{URI: index})
+	}
+
+	for _, dependency := range cfg.MaskedDependencies() {
+		if !strings.HasPrefix(dependency, "git+") {
+			continue
+		}
+
+		material := slsacommon.ProvenanceMaterial{URI: dependency}
+		// only commits identify the sources, branches and tags can move
+		ref, _, _ := strings.Cut(dependency[strings.LastIndex(dependency, "@")+1:], "#")
+		if commitPattern.MatchString(ref) {
+			material.Digest = slsacommon.DigestSet{"sha1": ref}
+		}
+		materials = append(materials, material)
+	}
+
+	materials = append(materials, slsacommon.ProvenanceMaterial{
+		URI:    prov.Mopyfile,
+		Digest: slsacommon.DigestSet{prov.MopyfileDigest.Algorithm().String(): prov.MopyfileDigest.Encoded()},
+	})
+
+	return materials, nil
+}
+
+// indexUrls returns the urls of the package indices in use without their credentials.
+func indexUrls(c *config.Config) []string {
+	var urls []string
+
+	if c.PrimaryIndex() == -1 {
+		urls = append(urls, pypiUrl)
+	}
+
+	for _, index := range c.Indices {
+		indexUrl := index.URL()
+		indexUrl.User = nil
+		urls = append(urls, indexUrl.String())
+	}
+
+	return urls
+}
@@ -0,0 +1,133 @@
+package llb
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/containerd/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+var pythonMinorPattern = regexp.MustCompile(`^\d+\.\d+`)
+
+// knownImage is an image mopy uses unless overridden, like the distroless runtime images and the uv image.
+type knownImage struct {
+	Image string
+	// Digest pins the image index, the platform specific image is selected from it by BuildKit. Renovate adds and
+	// updates the digests of the table, entries it hasn't pinned yet are only referenced by their tag.
+	Digest string
+	// Release is the Debian release of the image. The builder uses the Python image of the same release, so the
+	// installed extension modules and the copied shared libraries match the glibc of the runtime image.
+	Release string
+	// Platforms the image is published for.
+	Platforms []string
+}
+
+// Ref returns the reference of the image, pinned to its digest if known.
+func (b knownImage) Ref() string {
+	if b.Digest == "" {
+		return b.Image
+	}
+
+	return b.Image + "@" + b.Digest
+}
+
+func (b knownImage) supports(p ocispecs.Platform) bool {
+	matcher := platforms.NewMatcher(p)
+	for _, supported := range b.Platforms {
+		if matcher.Match(platforms.MustParse(supported)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runtimeBases maps the Python minor versions to the distroless images shipping exactly that version. Only images
+// whose tag is bound to a Debian release belong here, the Python version of floating tags like python3:nonroot changes
+// with the release. The Image and Digest fields are matched by the custom manager in renovate.json, keep them on
+// consecutive lines.
+var runtimeBases = map[string]knownImage{
+	"3.11": {
+		Image:     "gcr.io/distroless/python3-debian12:nonroot",
+		Release:   "bookworm",
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+	},
+	"3.13": {
+		Image:     "gcr.io/distroless/python3-debian13:nonroot",
+		Release:   "trixie",
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+	},
+}
+
+// uvBase provides the uv binary, which is mounted into the build stage.
+var uvBase = knownImage{
+	Image:     "ghcr.io/astral-sh/uv:0.4.30",
+	Platforms: []string{"linux/amd64", "linux/arm64"},
+}
+
+// builderBaseImage returns the base image of the build stage for the target platform. With a distroless runtime image
+// it is the Python image of the same Debian release, the slim runtime image follows the release of the default tag.
+func builderBaseImage(c *config.Config, p ocispecs.Platform) string {
+	if c.Base != nil && c.Base.Builder != "" {
+		return c.Base.Builder
+	}
+
+	if base, ok := distrolessBase(c, p); ok {
+		return fmt.Sprintf("python:%s-%s", c.PythonVersion, base.Release)
+	}
+
+	return "python:" + c.PythonVersion
+}
+
+// runtimeBaseImage returns the base image of the final stage for the target platform and if it is one of the distroless
+// images, which already provide the nonroot user. Versions and platforms without a distroless image as well as images
+// requiring runtime dependencies fall back to the slim image. Overridden images are not assumed to be distroless.
+func runtimeBaseImage(c *config.Config, p ocispecs.Platform) (string, bool) {
+	if overriddenRuntime(c) {
+		return c.Base.Runtime, false
+	}
+
+	if base, ok := distrolessBase(c, p); ok {
+		return base.Ref(), true
+	}
+
+	return fmt.Sprintf("python:%s-slim", c.PythonVersion), false
+}
+
+// distrolessBase returns the distroless runtime image of the table for the Python version and the platform p, if the
+// runtime image isn't overridden.
+func distrolessBase(c *config.Config, p ocispecs.Platform) (knownImage, bool) {
+	// distroless images have no package manager to install the runtime dependencies with
+	if overriddenRuntime(c) || len(c.RuntimeDeps) > 0 {
+		return knownImage{}, false
+	}
+
+	base, ok := runtimeBases[pythonMinorPattern.FindString(c.PythonVersion)]
+	if !ok || !base.supports(p) {
+		return knownImage{}, false
+	}
+
+	return base, true
+}
+
+// overriddenRuntime reports if base.runtime replaces the runtime image. Whether it provides the user and the shared
+// libraries of the dependencies is unknown, the user is created if missing and the libraries are copied like for
+// distroless images.
+func overriddenRuntime(c *config.Config) bool {
+	return c.Base != nil && c.Base.Runtime != ""
+}
+
+// withSupportedInstaller returns c with pip as installer, if uv is configured but its image isn't published for the
+// target platform p.
+func withSupportedInstaller(c *config.Config, p ocispecs.Platform) *config.Config {
+	if c.Installer != config.InstallerUv || uvBase.supports(p) {
+		return c
+	}
+
+	fallback := *c
+	fallback.Installer = config.InstallerPip
+
+	return &fallback
+}
@@ -0,0 +1,105 @@
+package llb
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+func TestBaseImages(t *testing.T) {
+	amd64 := platforms.MustParse("linux/amd64")
+
+	tests := []struct {
+		name           string
+		config         config.Config
+		platform       string
+		wantBuilder    string
+		wantRuntime    string
+		wantDistroless bool
+	}{
+		{
+			name:           "distroless",
+			config:         config.Config{PythonVersion: "3.11"},
+			wantBuilder:    "python:3.11-bookworm",
+			wantRuntime:    "gcr.io/distroless/python3-debian12:nonroot",
+			wantDistroless: true,
+		},
+		{
+			name:           "distroless of a patch version",
+			config:         config.Config{PythonVersion: "3.13.1"},
+			wantBuilder:    "python:3.13.1-trixie",
+			wantRuntime:    "gcr.io/distroless/python3-debian13:nonroot",
+			wantDistroless: true,
+		},
+		{
+			name:        "no distroless image",
+			config:      config.Config{PythonVersion: "3.9"},
+			wantBuilder: "python:3.9",
+			wantRuntime: "python:3.9-slim",
+		},
+		{
+			name:        "unsupported platform",
+			config:      config.Config{PythonVersion: "3.11"},
+			platform:    "linux/s390x",
+			wantBuilder: "python:3.11",
+			wantRuntime: "python:3.11-slim",
+		},
+		{
+			name:        "runtime dependencies",
+			config:      config.Config{PythonVersion: "3.11", RuntimeDeps: []string{"libpq5"}},
+			wantBuilder: "python:3.11",
+			wantRuntime: "python:3.11-slim",
+		},
+		{
+			name:        "overridden",
+			config:      config.Config{PythonVersion: "3.11", Base: &config.Base{Builder: "mirror.company.org/python:3.11", Runtime: "mirror.company.org/python3-debian12:nonroot"}},
+			wantBuilder: "mirror.company.org/python:3.11",
+			wantRuntime: "mirror.company.org/python3-debian12:nonroot",
+		},
+		{
+			name:        "overridden runtime",
+			config:      config.Config{PythonVersion: "3.11", Base: &config.Base{Runtime: "mirror.company.org/python3-debian12:nonroot"}},
+			wantBuilder: "python:3.11",
+			wantRuntime: "mirror.company.org/python3-debian12:nonroot",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := amd64
+			if tt.platform != "" {
+				p = platforms.MustParse(tt.platform)
+			}
+
+			if got := builderBaseImage(&tt.config, p); got != tt.wantBuilder {
+				t.Errorf("builderBaseImage() = %s, want %s", got, tt.wantBuilder)
+			}
+			got, distroless := runtimeBaseImage(&tt.config, p)
+			if got != tt.wantRuntime || distroless != tt.wantDistroless {
+				t.Errorf("runtimeBaseImage() = %s, %t, want %s, %t", got, distroless, tt.wantRuntime, tt.wantDistroless)
+			}
+		})
+	}
+}
+
+func TestWithSupportedInstaller(t *testing.T) {
+	tests := []struct {
+		platform string
+		want     string
+	}{
+		{platform: "linux/amd64", want: config.InstallerUv},
+		{platform: "linux/arm64", want: config.InstallerUv},
+		{platform: "linux/s390x", want: config.InstallerPip},
+	}
+
+	for _, tt := range tests {
+		c := &config.Config{PythonVersion: "3.11", Installer: config.InstallerUv}
+		if got := withSupportedInstaller(c, platforms.MustParse(tt.platform)).Installer; got != tt.want {
+			t.Errorf("withSupportedInstaller(%s).Installer = %s, want %s", tt.platform, got, tt.want)
+		}
+		if c.Installer != config.InstallerUv {
+			t.Errorf("withSupportedInstaller(%s) changed the installer of the config", tt.platform)
+		}
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/client/llb/sourceresolver"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
-	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/attestations"
+	sbomscan "github.com/moby/buildkit/frontend/attestations/sbom"
 	"github.com/moby/buildkit/frontend/dockerui" // For dockerui.Config and dockerui.Client
 	gatewayclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	fstypes "github.com/tonistiigi/fsutil/types"
 	"gitlab.com/cmdjulian/mopy/pkg/config" // Your project's config package
 	"golang.org/x/sync/errgroup"
 )
@@ -26,39 +32,54 @@ const (
 	keyCacheImports   = "cache-imports"
 	keyConfigPath     = "filename" // User-provided option for the Mopyfile path within the context
 	keyTargetPlatform = "platform"
+	keyTarget         = "target" // Target of the Mopyfile to build, e.g. set by --target
+	keyStrict         = "strict" // Fail on warnings like unknown keys, set by --opt strict=true
+	keyStrictBuildArg = "build-arg:MOPY_STRICT"
 )
 
 // Build is the main function for your custom BuildKit frontend.
-// It reads a Mopyfile, converts it to Dockerfile content, then to LLB, and solves it.
+// It reads a Mopyfile, converts it directly to LLB, and solves it.
 func Build(ctx context.Context, c gatewayclient.Client) (*gatewayclient.Result, error) {
 	// 1. Load your Mopyfile configuration.
 	// Assumes Mopyfile.yaml (or path from keyConfigPath) is in the main build context.
-	mopyConfig, err := readMopyConfig(ctx, c)
+	mopyConfig, prov, err := readMopyConfig(ctx, c)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to load mopy configuration")
 	}
 
-	// 2. Convert Mopyfile config to Dockerfile content string using your custom logic.
-	dockerfileContent := Mopyfile2LLB(mopyConfig)
-
 	buildOpts := c.BuildOpts()
 	opts := buildOpts.Opts // Raw build options (like --build-arg, --platform) from the client.
 
-	// 3. Initialize dockerui.Client. This is crucial for standard frontend behaviors.
-	// - It parses global build opts (like --build-arg) into duc.Config.
+	mopyConfig, err = mopyConfig.ForTarget(opts[keyTarget])
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Initialize dockerui.Client. This is crucial for standard frontend behaviors.
+	// - It parses global build opts (like --label) into duc.Config.
 	// - It provides duc.MainContext(), which loads the primary build context and handles .dockerignore.
 	duc, err := dockerui.NewClient(c)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create dockerui client")
 	}
 
+	mainContext, err := duc.MainContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load build context")
+	}
+
 	cacheImports, err := parseCacheOptions(opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse cache import options")
 	}
 
-	// 4. Determine target platforms for the build.
-	targetPlatforms := []*ocispecs.Platform{nil} // Default to BuildKit daemon's platform if none specified.
+	// 3. Determine target platforms for the build.
+	targetPlatforms := []*ocispecs.Platform{nil}
+	// Default to the platform of the BuildKit worker if none specified, the frontend may run on a different one.
+	if workers := buildOpts.Workers; len(workers) > 0 && len(workers[0].Platforms) > 0 {
+		workerPlatform := platforms.Normalize(workers[0].Platforms[0])
+		targetPlatforms = []*ocispecs.Platform{&workerPlatform}
+	}
 	if platformStr, exists := opts[keyTargetPlatform]; exists && platformStr != "" {
 		parsedPlatforms, parseErr := parsePlatforms(platformStr)
 		if parseErr != nil {
@@ -67,37 +88,65 @@ func Build(ctx context.Context, c gatewayclient.Client) (*gatewayclient.Result,
 		targetPlatforms = parsedPlatforms
 	}
 
+	// SBOM attestations are only generated if requested by the client, e.g. with --sbom.
+	var scanner sbomscan.Scanner
+	if duc.SBOM != nil {
+		scanner, err = sbomscan.CreateSBOMScanner(ctx, c, duc.SBOM.Generator, sourceresolver.Opt{
+			ImageOpt: &sourceresolver.ResolveImageOpt{
+				ResolveMode: opts["image-resolve-mode"],
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create sbom scanner")
+		}
+	}
+
+	// The provenance of mopy is attached next to the one of BuildKit, if requested by the client, e.g. with --provenance.
+	attests, err := attestations.Parse(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse attestation options")
+	}
+	provAttrs, withProvenance := attests[attestations.KeyTypeProvenance]
+	if withProvenance && (provAttrs["mode"] == "disabled" || provAttrs["disabled"] == "true") {
+		withProvenance = false
+	}
+
 	isMultiPlatform := len(targetPlatforms) > 1
+	builtImageResults := make([]*buildResult, len(targetPlatforms))
 	exportPlatforms := &exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(targetPlatforms)),
 	}
 	finalResult := gatewayclient.NewResult()
 	eg, egCtx := errgroup.WithContext(ctx) // Use errgroup's context for concurrent operations.
 
-	// 5. For each target platform, convert the generated Dockerfile content to LLB and solve.
+	// 4. For each target platform, convert the Mopyfile to LLB and solve.
 	for i, tp := range targetPlatforms {
 		currentIndex := i
 		currentTargetPlatform := tp
 
 		eg.Go(func() (err error) {
-			// Prepare options for dockerfile2llb. This is where build args and .dockerignore handling
-			// are implicitly configured for the standard converter.
-			convertOpt := dockerfile2llb.ConvertOpt{
-				Config: duc.Config, // Contains parsed BuildArgs, Labels, etc., from global opts.
-				Client: duc,        // Allows dockerfile2llb to access MainContext (with .dockerignore).
-				// MainContext: nil, // Setting to nil ensures dockerfile2llb uses Client.MainContext().
-				TargetPlatform: currentTargetPlatform, // Platform for this specific LLB conversion.
-				MetaResolver:   c,                     // For resolving image names.
-				LLBCaps:        &buildOpts.LLBCaps,    // BuildKit features/capabilities.
+			llbOpt := Opt{
+				Context:      mainContext,           // Build context with .dockerignore applied.
+				MetaResolver: c,                     // For resolving the base image configs.
+				Platform:     currentTargetPlatform, // Platform for this specific LLB conversion.
+				ReadFile: func(ctx context.Context, st llb.State, filename string) ([]byte, error) {
+					return solveAndReadFile(ctx, c, st, filename, cacheImports)
+				},
+				StatFile: func(ctx context.Context, st llb.State, filename string) (*fstypes.Stat, error) {
+					return solveAndStatFile(ctx, c, st, filename, cacheImports)
+				},
+				BuildConfig: &duc.Config, // Proxies, extra hosts, network, --pull, cache namespace and SOURCE_DATE_EPOCH.
+				NoCache:     duc.IsNoCache,
 			}
 
-			// buildImage encapsulates Dockerfile2LLB conversion and the subsequent Solve.
-			builtImageResult, buildErr := buildImage(egCtx, c, dockerfileContent, convertOpt, cacheImports, isMultiPlatform)
+			// buildImage encapsulates the LLB conversion and the subsequent Solve.
+			builtImageResult, buildErr := buildImage(egCtx, c, mopyConfig, llbOpt, duc.Labels, cacheImports, isMultiPlatform)
 			if buildErr != nil {
 				return errors.Wrapf(buildErr, "failed to build image for platform %v", currentTargetPlatform)
 			}
 
 			builtImageResult.AddToClientResult(finalResult)
+			builtImageResults[currentIndex] = builtImageResult
 			exportPlatforms.Platforms[currentIndex] = builtImageResult.ExportPlatform
 			return nil
 		})
@@ -107,14 +156,31 @@ func Build(ctx context.Context, c gatewayclient.Client) (*gatewayclient.Result,
 		return nil, err // Return the first error encountered in the goroutines.
 	}
 
-	// If multi-platform, add platform metadata to the result.
-	if isMultiPlatform {
-		dt, err := json.Marshal(exportPlatforms)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to marshal multi-platform export metadata")
+	// 5. Attach the attestations of each platform, they are keyed by the platform ID.
+	eg, egCtx = errgroup.WithContext(ctx)
+	for _, br := range builtImageResults {
+		currentResult := br
+		if scanner != nil {
+			eg.Go(func() error {
+				return attachSBOM(egCtx, c, scanner, currentResult, finalResult)
+			})
+		}
+		if withProvenance {
+			eg.Go(func() error {
+				return attachProvenance(egCtx, c, mopyConfig, prov, currentResult, finalResult)
+			})
 		}
-		finalResult.AddMeta(exptypes.ExporterPlatformsKey, dt)
 	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Add platform metadata to the result, the exporter requires it to match attestations to platforms.
+	dt, err := json.Marshal(exportPlatforms)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal platform export metadata")
+	}
+	finalResult.AddMeta(exptypes.ExporterPlatformsKey, dt)
 
 	return finalResult, nil
 }
@@ -149,10 +215,12 @@ func parseCacheOptions(opts map[string]string) ([]gatewayclient.CacheOptionsEntr
 type buildResult struct {
 	Reference      gatewayclient.Reference
 	ImageConfig    []byte
-	BuildInfo      []byte // Not currently populated. For future SBOM/metadata.
+	BuildInfo      []byte // Not currently populated. For future metadata.
+	State          *llb.State
 	Platform       *ocispecs.Platform
 	MultiPlatform  bool
 	ExportPlatform exptypes.Platform
+	BaseImages     []string // The images the build used, pinned to their digest.
 }
 
 // AddToClientResult merges a single platform's build result into the final gateway client result.
@@ -166,18 +234,21 @@ func (br *buildResult) AddToClientResult(cr *gatewayclient.Result) {
 	}
 }
 
-// buildImage converts Dockerfile content to LLB and solves it for a specific platform.
-func buildImage(ctx context.Context, c gatewayclient.Client, dockerfileContent string, convertOpts dockerfile2llb.ConvertOpt, cacheImports []gatewayclient.CacheOptionsEntry, isMultiPlatformBuild bool) (*buildResult, error) {
+// buildImage converts the Mopyfile to LLB and solves it for a specific platform.
+func buildImage(ctx context.Context, c gatewayclient.Client, mopyConfig *config.Config, llbOpt Opt, labels map[string]string, cacheImports []gatewayclient.CacheOptionsEntry, isMultiPlatformBuild bool) (*buildResult, error) {
 	result := buildResult{
-		Platform:      convertOpts.TargetPlatform,
+		Platform:      llbOpt.Platform,
 		MultiPlatform: isMultiPlatformBuild,
 	}
 
-	// Convert the (generated) Dockerfile content to LLB state.
-	// Build args and .dockerignore (via convertOpts.Client.MainContext) are handled here.
-	state, image, _, _, err := dockerfile2llb.Dockerfile2LLB(ctx, []byte(dockerfileContent), convertOpts)
+	state, image, baseImages, err := mopyfile2LLB(ctx, mopyConfig, llbOpt)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to convert Dockerfile content to LLB state")
+		return nil, errors.Wrap(err, "failed to convert Mopyfile to LLB state")
+	}
+
+	// Labels passed with --label take precedence over the ones of the Mopyfile.
+	for key, value := range labels {
+		image.Config.Labels[key] = value
 	}
 
 	result.ImageConfig, err = json.Marshal(image)
@@ -185,7 +256,9 @@ func buildImage(ctx context.Context, c gatewayclient.Client, dockerfileContent s
 		return nil, errors.Wrapf(err, "failed to marshal image config to JSON")
 	}
 
-	result.BuildInfo = []byte{} // SBOM targets (4th return from Dockerfile2LLB) are not processed here.
+	result.State = state
+	result.BaseImages = baseImages
+	result.BuildInfo = []byte{} // Not populated, SBOMs are attached as attestations.
 
 	// Marshal the LLB state to its protobuf definition for solving.
 	def, err := state.Marshal(ctx)
@@ -218,8 +291,9 @@ func buildImage(ctx context.Context, c gatewayclient.Client, dockerfileContent s
 	return &result, nil
 }
 
-// readMopyConfig loads the Mopyfile from the main build context.
-func readMopyConfig(ctx context.Context, c gatewayclient.Client) (*config.Config, error) {
+// readMopyConfig loads the Mopyfile and the files it references from the main build context. Besides the config, the
+// path and digest of the Mopyfile are returned for the provenance.
+func readMopyConfig(ctx context.Context, c gatewayclient.Client) (*config.Config, provenance, error) {
 	opts := c.BuildOpts().Opts
 	filename := opts[keyConfigPath] // Get Mopyfile path from --opt filename=...
 	if filename == "" {
@@ -231,41 +305,163 @@ func readMopyConfig(ctx context.Context, c gatewayclient.Client) (*config.Config
 		internalName += " from " + filename
 	}
 
-	// Define the LLB source for the Mopyfile, expecting it in the main build context.
-	src := llb.Local(
+	mopyfileYaml, err := readContextFile(ctx, c, filename, defaultDockerfileName, internalName)
+	if err != nil {
+		return nil, provenance{}, errors.Wrap(err, "failed to read Mopyfile")
+	}
+	prov := provenance{Mopyfile: filename, MopyfileDigest: digest.FromBytes(mopyfileYaml)}
+
+	cfg, err := config.NewFromBytes(mopyfileYaml)
+	if err != nil {
+		return nil, provenance{}, errors.Wrap(err, "failed to parse Mopyfile YAML content")
+	}
+	if err := reportWarnings(ctx, c, cfg, filename, mopyfileYaml, internalName); err != nil {
+		return nil, provenance{}, err
+	}
+
+	err = cfg.LoadFiles(func(name string) ([]byte, error) {
+		return readContextFile(ctx, c, name, name, "load "+name)
+	})
+	if err != nil {
+		return nil, provenance{}, errors.Wrap(err, "failed to load files referenced by the Mopyfile")
+	}
+
+	return cfg, prov, nil
+}
+
+// contextFile returns the LLB source of a single file, expecting it in the main build context.
+func contextFile(c gatewayclient.Client, filename, sharedKeyHint, internalName string) llb.State {
+	return llb.Local(
 		localNameContext,                        // Load from the main build context (e.g., "context")
-		llb.IncludePatterns([]string{filename}), // Target the specific Mopyfile.
+		llb.IncludePatterns([]string{filename}), // Target the specific file.
 		llb.SessionID(c.BuildOpts().SessionID),
-		llb.SharedKeyHint(defaultDockerfileName), // Cache hint.
-		dockerui.WithInternalName(internalName),  // Internal name for BuildKit logs.
+		llb.SharedKeyHint(sharedKeyHint),        // Cache hint.
+		dockerui.WithInternalName(internalName), // Internal name for BuildKit logs.
 	)
+}
+
+// reportWarnings prints the warnings of the Mopyfile, like unknown keys, with the build output. In strict mode, set by
+// --opt strict=true or --build-arg MOPY_STRICT=true, they fail the build instead.
+func reportWarnings(ctx context.Context, c gatewayclient.Client, cfg *config.Config, filename string, mopyfileYaml []byte, internalName string) error {
+	opts := c.BuildOpts().Opts
+	strict := opts[keyStrict]
+	if strict == "" {
+		strict = opts[keyStrictBuildArg]
+	}
+	if strict != "" {
+		isStrict, err := strconv.ParseBool(strict)
+		if err != nil {
+			return errors.Wrapf(err, "invalid value %s for strict", strict)
+		}
+		if isStrict {
+			return cfg.Strict()
+		}
+	}
+	if len(cfg.Warnings) == 0 {
+		return nil
+	}
+
+	// warnings are attached to the vertex loading the Mopyfile
+	def, err := contextFile(c, filename, defaultDockerfileName, internalName).Marshal(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal Mopyfile source")
+	}
+	vertex, err := def.Head()
+	if err != nil {
+		return errors.Wrap(err, "failed to get Mopyfile source vertex")
+	}
+
+	sourceInfo := &pb.SourceInfo{Filename: filename, Data: mopyfileYaml, Language: "YAML", Definition: def.ToPB()}
+	for _, warning := range cfg.Warnings {
+		position := pb.Position{Line: int32(warning.Line), Character: int32(warning.Column)}
+		err := c.Warn(ctx, vertex, warning.Message, gatewayclient.WarnOpts{
+			Level:      1,
+			SourceInfo: sourceInfo,
+			Range:      []*pb.Range{{Start: position, End: position}},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to report Mopyfile warning")
+		}
+	}
+
+	return nil
+}
+
+// readContextFile reads a single file from the main build context.
+func readContextFile(ctx context.Context, c gatewayclient.Client, filename, sharedKeyHint, internalName string) ([]byte, error) {
+	src := contextFile(c, filename, sharedKeyHint, internalName)
 
 	def, err := src.Marshal(ctx) // Use the passed-in context for marshalling.
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal local source for Mopyfile (%s)", filename)
+		return nil, errors.Wrapf(err, "failed to marshal local source for %s", filename)
 	}
 
 	res, err := c.Solve(ctx, gatewayclient.SolveRequest{Definition: def.ToPB()})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to solve for Mopyfile source (%s)", filename)
+		return nil, errors.Wrapf(err, "failed to solve for source of %s", filename)
 	}
 
 	ref, err := res.SingleRef()
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get single reference for Mopyfile source solve (%s)", filename)
+		return nil, errors.Wrapf(err, "failed to get single reference for source solve of %s", filename)
 	}
 
-	mopyfileYaml, err := ref.ReadFile(ctx, gatewayclient.ReadRequest{Filename: filename})
+	dt, err := ref.ReadFile(ctx, gatewayclient.ReadRequest{Filename: filename})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read Mopyfile content: %s", filename)
+		return nil, errors.Wrapf(err, "failed to read content of %s", filename)
 	}
 
-	cfg, err := config.NewFromBytes(mopyfileYaml)
+	return dt, nil
+}
+
+// solveAndReadFile solves an intermediate state and reads a single file from it.
+func solveAndReadFile(ctx context.Context, c gatewayclient.Client, st llb.State, filename string, cacheImports []gatewayclient.CacheOptionsEntry) ([]byte, error) {
+	ref, err := solveState(ctx, c, st, "reading "+filename, cacheImports)
+	if err != nil {
+		return nil, err
+	}
+
+	dt, err := ref.ReadFile(ctx, gatewayclient.ReadRequest{Filename: filename})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read content of %s", filename)
+	}
+
+	return dt, nil
+}
+
+// solveAndStatFile solves an intermediate state and stats a single file in it.
+func solveAndStatFile(ctx context.Context, c gatewayclient.Client, st llb.State, filename string, cacheImports []gatewayclient.CacheOptionsEntry) (*fstypes.Stat, error) {
+	ref, err := solveState(ctx, c, st, "checking "+filename, cacheImports)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := ref.StatFile(ctx, gatewayclient.StatRequest{Path: filename})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %s", filename)
+	}
+
+	return stat, nil
+}
+
+// solveState solves an intermediate state for inspecting its files, purpose is part of the errors.
+func solveState(ctx context.Context, c gatewayclient.Client, st llb.State, purpose string, cacheImports []gatewayclient.CacheOptionsEntry) (gatewayclient.Reference, error) {
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal state for %s", purpose)
+	}
+
+	res, err := c.Solve(ctx, gatewayclient.SolveRequest{Definition: def.ToPB(), CacheImports: cacheImports})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to solve state for %s", purpose)
+	}
+
+	ref, err := res.SingleRef()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse Mopyfile YAML content")
+		return nil, errors.Wrapf(err, "failed to get single reference for %s", purpose)
 	}
 
-	return cfg, nil
+	return ref, nil
 }
 
 // parsePlatforms converts a comma-separated string of platform specs into a slice of *ocispecs.Platform.
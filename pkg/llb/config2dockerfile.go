@@ -2,154 +2,122 @@ package llb
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"gitlab.com/cmdjulian/mopy/pkg/config"
-	"gitlab.com/cmdjulian/mopy/pkg/utils"
 	"golang.org/x/exp/maps"
-	"log"
-	"net/url"
-	"regexp"
-	"runtime"
-	"strings"
 )
 
-const pipCacheMount = "--mount=type=cache,target=/root/.cache"
 const aptCacheMount = "--mount=type=cache,target=/var/cache/apt --mount=type=cache,target=/var/lib/apt"
 
-var placeholderPattern = regexp.MustCompile(`^\$\{.+}$`)
-
-var defaultEnvs = map[string]string{
-	"PIP_DISABLE_PIP_VERSION_CHECK": "1",
-	"PIP_NO_WARN_SCRIPT_LOCATION":   "0",
-	"PIP_USER":                      "1",
-	"PYTHONPYCACHEPREFIX":           "$HOME/.pycache",
-	"GIT_SSH_COMMAND":               "ssh -o StrictHostKeyChecking=no",
-}
-
-var defaulLabels = map[string]string{
-	"org.opencontainers.image.description": "autogenerated by mopy",
-	"moby.buildkit.frontend":               "mopy",
-	"mopy.version":                         "v1",
-}
-
-func Mopyfile2LLB(c *config.Config) string {
-	dockerfile := buildStage(c)
-	dockerfile += runStage(c)
+// Mopyfile2Dockerfile renders the Mopyfile as an equivalent Dockerfile for the target platform p, which determines the
+// runtime base image and if uv is available. The frontend itself builds the LLB directly through Mopyfile2LLB, the Dockerfile is meant for
+// debugging and exporting only.
+func Mopyfile2Dockerfile(c *config.Config, p ocispecs.Platform) string {
+	c = withSupportedInstaller(c, p)
+	dockerfile := buildStage(c, p)
+	dockerfile += libraries(c, p)
+	dockerfile += runStage(c, p)
 
 	return dockerfile
 }
 
-func buildStage(c *config.Config) string {
-	dockerfile := from(c)
+func buildStage(c *config.Config, p ocispecs.Platform) string {
+	dockerfile := from(c, p)
 	dockerfile += apt(c)
-	dockerfile += env(utils.Union(defaultEnvs, c.Envs))
+	dockerfile += env(builderEnvs(c))
+	dockerfile += generated(c)
+	dockerfile += installLocked(c)
 	dockerfile += installDeps(c)
 
+	// the dependencies of the target are installed on top, so all targets share the layer of the common ones
+	if target := c.TargetInstall(); hasPipInstall(target) {
+		dockerfile += generated(target)
+		dockerfile += installDeps(target)
+	}
+
 	return dockerfile
 }
 
-// Determine flags like mount, ssh and cache
-// transform local deps into relative paths, requirements.txt and ssh
-// install all at one (local, requirements.txt, ssh, http and pypi)
-func installDeps(c *config.Config) string {
-	if len(c.PipDependencies) == 0 {
+// install the hash pinned packages of the poetry.lock in a separate step, as pip's hash checking mode would otherwise
+// apply to all other dependencies as well
+func installLocked(c *config.Config) string {
+	if c.Poetry == nil {
 		return ""
 	}
 
-	flags := flags(c)
-	args := args(c)
-	indices := indices(c)
+	return fmt.Sprintf("\nRUN %s %s", installerFlags(c), execForm(poetryInstallArgs(c)))
+}
 
-	COPY := ""
-	RUN := fmt.Sprintf("\nRUN %s pip install %s %s", flags, indices, args)
-
-	for i, s := range c.LocalDependencies() {
-		if !strings.HasSuffix(s, "/requirements.txt") {
-			s = strings.TrimSuffix(s, "/")
-			source := strings.TrimPrefix(s, "./")
-			s = utils.After(s, "/") + "/"
-			target := fmt.Sprintf("/tmp/%d%s", i, s)
-			// should be supported with buildkit but isn't
-			COPY += fmt.Sprintf("\nCOPY --link %s %s", source, target)
-		}
+// generated writes the files created by mopy, like hash pinned requirements, into the builder stage
+func generated(c *config.Config) string {
+	line := ""
+
+	files := generatedFiles(c)
+	for _, target := range sortedKeys(files) {
+		line += fmt.Sprintf("\nCOPY <<\"EOF\" %s\n%sEOF", target, files[target])
 	}
 
-	return COPY + RUN
+	return line
 }
 
-func indices(c *config.Config) string {
-	if len(c.Indices) <= 0 {
+// Determine flags like mount, ssh and cache
+// transform local deps into relative paths, requirements.txt and ssh
+// install all at one (local, requirements.txt, ssh, http and pypi)
+func installDeps(c *config.Config) string {
+	if !hasPipInstall(c) {
 		return ""
 	}
 
-	indices := "--retries 2"
-
-	for _, index := range c.Indices {
-		indexUrl, err := url.Parse(index.Url)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) == 0 {
-			indexUrl.User = url.User(index.Username)
-		}
-
-		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) != 0 {
-			indexUrl.User = url.UserPassword(index.Username, index.Password)
-		}
-
-		indices += fmt.Sprintf(" --extra-index-url %s", indexUrl.String())
+	COPY := ""
+	// exec form, as requirements like requests>=2 would be redirections of the shell
+	RUN := fmt.Sprintf("\nRUN %s %s", flags(c), execForm(pipInstallArgs(c)))
 
-		if index.Trust {
-			indices += fmt.Sprintf(" --trusted-host %s", indexUrl.Host)
+	for _, dep := range localDependencies(c) {
+		if !dep.Requirements {
+			// should be supported with buildkit but isn't
+			COPY += fmt.Sprintf("\nCOPY --link %s %s", dep.Source, dep.Target)
 		}
 	}
 
-	return indices
+	return COPY + RUN
 }
 
-func args(c *config.Config) string {
-	args := ""
-
-	for i, s := range c.LocalDependencies() {
-		if strings.HasSuffix(s, "/requirements.txt") {
-			target := fmt.Sprintf("/tmp/%drequirements.txt", i)
-			args += fmt.Sprintf("-r %s ", target)
-		} else {
-			s = strings.TrimSuffix(s, "/")
-			s = utils.After(s, "/") + "/"
-			target := fmt.Sprintf("/tmp/%d%s", i, s)
-			args += fmt.Sprintf("%s ", target)
-		}
+// installerFlags returns the mounts required by the installer, its cache, the uv binary and the index secrets.
+func installerFlags(c *config.Config) string {
+	flags := fmt.Sprintf("--mount=type=cache,target=%s", installerCacheDir(c))
+
+	if c.Installer == config.InstallerUv {
+		flags += fmt.Sprintf(" --mount=from=%s,source=/uv,target=%s", uvBase.Ref(), uvBinary)
 	}
 
-	deps := append(append(c.PyPiDependencies(), c.HttpDependencies()...), c.SshDependencies()...)
-	if len(deps) > 0 {
-		depString := strings.Join(deps, " ")
-		args += fmt.Sprintf("%s ", depString)
+	for _, secret := range indexSecrets(c) {
+		flags += fmt.Sprintf(" --mount=type=secret,id=%s,env=%s,required=true", secret.ID, secret.Env)
 	}
 
-	return args
+	return flags
 }
 
 func flags(c *config.Config) string {
-	flags := pipCacheMount
+	flags := installerFlags(c)
 
 	if len(c.SshDependencies()) > 0 {
 		flags += " --mount=type=ssh,required=true"
 	}
 
-	for i, s := range c.LocalDependencies() {
-		if strings.HasSuffix(s, "/requirements.txt") {
-			target := fmt.Sprintf("/tmp/%drequirements.txt", i)
-			flags += fmt.Sprintf(" --mount=type=bind,source=%s,target=%s", s, target)
+	for _, dep := range localDependencies(c) {
+		if dep.Requirements {
+			flags += fmt.Sprintf(" --mount=type=bind,source=%s,target=%s", dep.Source, dep.Target)
 		}
 	}
 
 	return flags
 }
 
-func from(c *config.Config) string {
-	line := fmt.Sprintf("FROM python:%s AS builder\n", c.PythonVersion)
+func from(c *config.Config, p ocispecs.Platform) string {
+	line := fmt.Sprintf("FROM %s AS builder\n", builderBaseImage(c, p))
 	line += "RUN mkdir /build\n"
 	line += "WORKDIR /build\n"
 
@@ -159,14 +127,8 @@ func from(c *config.Config) string {
 func apt(c *config.Config) string {
 	line := "\n"
 
-	if len(c.HttpDependencies()) > 0 || len(c.SshDependencies()) > 0 {
-		line += fmt.Sprintf("RUN %s apt update && apt install -y git-lfs", aptCacheMount)
-	} else if len(c.Apt) > 0 {
-		line += fmt.Sprintf("RUN %s apt update && apt install -y ", aptCacheMount)
-	}
-
-	for _, apt := range c.Apt {
-		line += fmt.Sprintf(" %s", apt)
+	if packages := aptPackages(c); len(packages) > 0 {
+		line += fmt.Sprintf("RUN %s apt update && apt install -y %s", aptCacheMount, strings.Join(packages, " "))
 	}
 
 	return line
@@ -174,116 +136,156 @@ func apt(c *config.Config) string {
 
 func env(envs map[string]string) string {
 	line := "\nENV"
-	for key, value := range envs {
-		line += fmt.Sprintf(" %s=\"%s\"", key, value)
+	for _, key := range sortedKeys(envs) {
+		line += fmt.Sprintf(" %s=%s", key, quote(envs[key]))
 	}
 
 	return line
 }
 
-func runStage(c *config.Config) string {
+// libraries collects the shared libraries missing in a distroless runtime image in a separate stage
+func libraries(c *config.Config, p ocispecs.Platform) string {
+	image, distroless := runtimeBaseImage(c, p)
+	if !(distroless || overriddenRuntime(c)) || !c.HasDependencies() {
+		return ""
+	}
+
+	line := fmt.Sprintf("\n\nFROM builder AS %s", librariesStage)
+	line += fmt.Sprintf("\nRUN --mount=from=%s,target=%s <<\"EOF\"\n%sEOF", image, runtimeRootDir, librariesScript)
+
+	return line
+}
+
+func runStage(c *config.Config, p ocispecs.Platform) string {
 	line := "\n"
-	line += determineFinalBaseImage(c)
-	line += labels(c)
+	line += determineFinalBaseImage(c, p)
+	line += labels(c, p)
 
-	predefinedEnvs := map[string]string{"PYTHONUNBUFFERED": "1", "PATH": "$PATH:/home/nonroot/.local/bin"}
-	line += env(utils.Union(predefinedEnvs, c.Envs))
-	if len(c.PipDependencies) > 0 {
-		line += "\nCOPY --from=builder --chown=nonroot:nonroot /root/.local/ /home/nonroot/.local/"
+	user := runtimeUserOf(c)
+	line += env(runtimeEnvs(c))
+	if libraries(c, p) != "" {
+		line += fmt.Sprintf("\nCOPY --from=%s %s/ /", librariesStage, librariesDir)
+	}
+	if c.HasDependencies() {
+		line += fmt.Sprintf("\nCOPY --from=builder --chown=%s /root/.local/ %s/", user, user.LocalDir())
 	}
 
 	if c.Project != "" {
 		line += project(c)
 	}
+	if c.Workdir != "" {
+		line += "\nWORKDIR " + c.Workdir
+	}
+	line += runtimeConfig(c)
+	line += entrypoint(c)
 
 	return line
 }
 
-func determineFinalBaseImage(c *config.Config) string {
-	if strings.HasPrefix(c.PythonVersion, "3.9") {
-		switch runtime.GOARCH {
-		case "arm64", "amd64":
-			return distroless39()
-		}
+func determineFinalBaseImage(c *config.Config, p ocispecs.Platform) string {
+	image, distroless := runtimeBaseImage(c, p)
+	user := runtimeUserOf(c)
+	line := "FROM " + image
+
+	if overriddenRuntime(c) {
+		// overridden runtime images may run as another user by default
+		line += "\nUSER root"
+	}
+	if len(c.RuntimeDeps) > 0 {
+		line += fmt.Sprintf("\nRUN %s %s", aptCacheMount, runtimeAptCommand(c))
+	}
+
+	// the Dockerfile can't inspect overridden images, the command keeps a user already present
+	if !distroless {
+		line += "\nRUN " + user.addCommand()
 	}
 
-	return fallback(c)
+	return line + "\nUSER " + user.String()
 }
 
-func labels(c *config.Config) string {
+func labels(c *config.Config, p ocispecs.Platform) string {
 	line := "\nLABEL"
-	artificialLabels := map[string]string{
-		"mopy.python.version": c.PythonVersion,
+
+	base, _ := runtimeBaseImage(c, p)
+	labels := imageLabels(c, sbom(c), base)
+	for _, key := range sortedKeys(labels) {
+		line += fmt.Sprintf(" %s=%s", key, quote(labels[key]))
 	}
 
-	maps.Copy(artificialLabels, defaulLabels)
+	return line
+}
 
-	// add sbom if required
-	if c.Sbom == nil || *c.Sbom {
-		artificialLabels["mopy.sbom"] = sbom(c)
-	}
+func project(c *config.Config) string {
+	line := "\n"
 
-	for key, value := range artificialLabels {
-		line += fmt.Sprintf(" %s=\"%s\"", key, value)
-	}
+	target, workdir, _ := projectLayout(c)
+	line += fmt.Sprintf("COPY --chown=%s %s %s\n", runtimeUserOf(c), c.Project, target)
+	line += fmt.Sprintf("WORKDIR %s", workdir)
 
-	if len(c.Labels) > 0 {
-		// allow replacement of labels with placeholder lookup
-		all := utils.Union(artificialLabels, c.Labels)
-		for key, value := range c.Labels {
-			if placeholderPattern.MatchString(value) {
-				k := value[2 : len(value)-1]
-				line += fmt.Sprintf(" %s=\"%s\"", key, all[k])
-			} else {
-				line += fmt.Sprintf(" %s=\"%s\"", key, value)
-			}
+	return line
+}
+
+func runtimeConfig(c *config.Config) string {
+	line := ""
+
+	if ports := exposedPorts(c); len(ports) > 0 {
+		line += "\nEXPOSE " + strings.Join(ports, " ")
+	}
+	if len(c.Volumes) > 0 {
+		line += "\nVOLUME " + execForm(c.Volumes)
+	}
+	if hc := c.Healthcheck; hc != nil {
+		line += "\nHEALTHCHECK"
+		if hc.Interval > 0 {
+			line += " --interval=" + hc.Interval.String()
+		}
+		if hc.Timeout > 0 {
+			line += " --timeout=" + hc.Timeout.String()
+		}
+		if hc.Retries > 0 {
+			line += fmt.Sprintf(" --retries=%d", hc.Retries)
 		}
+		line += " CMD " + execForm(hc.Command)
+	}
+	if c.StopSignal != "" {
+		line += "\nSTOPSIGNAL " + c.StopSignal
 	}
 
 	return line
 }
 
-func sbom(c *config.Config) string {
-	line := "["
+func entrypoint(c *config.Config) string {
+	line := ""
 
-	lines := make([]string, 0)
-	for _, dependency := range c.MaskedDependencies() {
-		lines = append(lines, fmt.Sprintf("\\\"%s\\\"", dependency))
+	entrypoint, cmd := command(c)
+	if len(entrypoint) > 0 {
+		line += "\nENTRYPOINT " + execForm(entrypoint)
+	}
+	if len(cmd) > 0 {
+		line += "\nCMD " + execForm(cmd)
 	}
-
-	line += strings.Join(lines, ", ")
-	line += "]"
 
 	return line
 }
 
-func distroless39() string {
-	return "FROM gcr.io/distroless/python3:nonroot@sha256:49aeb0efbe5c01375e6d747c138c87cf89c6aa4dc5daac955b9afb6aba4027e4"
-}
-
-func fallback(c *config.Config) string {
-	line := fmt.Sprintf("FROM python:%s-slim\n", c.PythonVersion)
-	line += "RUN useradd --uid=65532 --user-group --home-dir=/home/nonroot --create-home nonroot\n"
-	line += "USER 65532:65532"
+// execForm renders args as exec form of a Dockerfile instruction.
+func execForm(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quote(arg)
+	}
 
-	return line
+	return "[ " + strings.Join(quoted, ", ") + " ]"
 }
 
-func project(c *config.Config) string {
-	line := "\n"
+// quote renders value as a double-quoted Dockerfile word.
+func quote(value string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+}
 
-	project := strings.TrimSuffix(c.Project, "/")
-	source := "/home/nonroot/" + utils.After(project, "/")
-	line += fmt.Sprintf("COPY --chown=nonroot:nonroot %s %s\n", c.Project, source)
-	line += "ENTRYPOINT [ \"python\" ]\n"
-
-	if strings.HasSuffix(c.Project, ".py") {
-		line += "WORKDIR /home/nonroot\n"
-		line += fmt.Sprintf("CMD [ \"%s\" ]", source)
-	} else {
-		line += fmt.Sprintf("WORKDIR %s\n", source)
-		line += "CMD [ \"main.py\" ]"
-	}
+func sortedKeys(m map[string]string) []string {
+	keys := maps.Keys(m)
+	sort.Strings(keys)
 
-	return line
+	return keys
 }
@@ -0,0 +1,535 @@
+package llb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/client/llb/sourceresolver"
+	"github.com/moby/buildkit/frontend/dockerui"
+	"github.com/moby/buildkit/util/system"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+// The stages of the build, as named by --no-cache-filter.
+const (
+	builderStage = "builder"
+	runtimeStage = "runtime"
+)
+
+// Opt holds the build specific settings for converting a Mopyfile into LLB.
+type Opt struct {
+	// Context is the build context local dependencies and the project are read from.
+	// Defaults to the local "context" if nil.
+	Context *llb.State
+	// MetaResolver resolves the image configs of the base images. Without a resolver the configs are not inherited.
+	MetaResolver llb.ImageMetaResolver
+	// Platform is the platform to build for, nil means the platform of the BuildKit daemon.
+	Platform *ocispecs.Platform
+	// ReadFile solves st and reads filename from it. It is used to inspect the builder stage while generating the
+	// final image. Without it, the sbom label lists the declared dependencies instead of the installed ones.
+	ReadFile func(ctx context.Context, st llb.State, filename string) ([]byte, error)
+	// StatFile solves st and stats filename in it. It is used to check if an overridden runtime image has a shell to
+	// create the user. Without it, the shell is assumed to be present.
+	StatFile func(ctx context.Context, st llb.State, filename string) (*fstypes.Stat, error)
+	// BuildConfig holds the options of the client, like the proxy build args, extra hosts, the network mode, the image
+	// resolve mode set by --pull, the cache id namespace and SOURCE_DATE_EPOCH. Without it the defaults of BuildKit apply.
+	BuildConfig *dockerui.Config
+	// NoCache reports if --no-cache or --no-cache-filter disables the cache of the stage, either builder or runtime.
+	NoCache func(stage string) bool
+}
+
+// Mopyfile2LLB converts a Mopyfile into the LLB state of the final image together with its image config.
+func Mopyfile2LLB(ctx context.Context, c *config.Config, opt Opt) (*llb.State, *dockerspec.DockerOCIImage, error) {
+	st, img, _, err := mopyfile2LLB(ctx, c, opt)
+	return st, img, err
+}
+
+// mopyfile2LLB is Mopyfile2LLB additionally returning the images the build uses, pinned to the digest they were
+// resolved to. They are recorded in the provenance.
+func mopyfile2LLB(ctx context.Context, c *config.Config, opt Opt) (*llb.State, *dockerspec.DockerOCIImage, []string, error) {
+	if opt.Context == nil {
+		opt.Context = dockerui.DefaultMainContext()
+	}
+	c = withSupportedInstaller(c, targetPlatform(opt))
+
+	builder, images, err := builderState(ctx, c, opt)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create builder stage")
+	}
+
+	st, img, runtimeImage, err := runtimeState(ctx, c, builder, opt)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create runtime stage")
+	}
+
+	return &st, img, append(images, runtimeImage), nil
+}
+
+// builderState returns the stage the dependencies are installed in together with the pinned builder and uv images.
+func builderState(ctx context.Context, c *config.Config, opt Opt) (llb.State, []string, error) {
+	st, _, builderImage, err := baseImage(ctx, builderBaseImage(c, targetPlatform(opt)), opt)
+	if err != nil {
+		return llb.State{}, nil, err
+	}
+	images := []string{builderImage}
+
+	var uv llb.State
+	if c.Installer == config.InstallerUv {
+		var uvPinned string
+		uv, _, uvPinned, err = baseImage(ctx, uvBase.Ref(), opt)
+		if err != nil {
+			return llb.State{}, nil, err
+		}
+		images = append(images, uvPinned)
+	}
+
+	st = st.File(llb.Mkdir("/build", 0755), llb.WithCustomName("[builder] mkdir /build")).Dir("/build")
+
+	if packages := aptPackages(c); len(packages) > 0 {
+		cmd := "apt update && apt install -y " + strings.Join(packages, " ")
+		st = st.Run(
+			llb.Args([]string{"/bin/sh", "-c", cmd}),
+			cacheMount(opt, "/var/cache/apt"),
+			cacheMount(opt, "/var/lib/apt"),
+			runOptions(opt, builderStage),
+			llb.WithCustomName("[builder] "+cmd),
+		).Root()
+	}
+
+	st, err = addEnvs(ctx, st, builderEnvs(c))
+	if err != nil {
+		return llb.State{}, nil, err
+	}
+
+	files := generatedFiles(c)
+
+	if c.Poetry != nil {
+		st = st.Run(
+			llb.Args(poetryInstallArgs(c)),
+			installerMounts(c, uv, opt),
+			runOptions(opt, builderStage),
+			generatedFile(poetryRequirements, files[poetryRequirements]),
+			llb.WithCustomName("[builder] pip install from "+c.Poetry.File()),
+		).Root()
+	}
+
+	if hasPipInstall(c) {
+		st = pipInstall(st, c, uv, opt, "[builder] pip install")
+	}
+
+	// the dependencies of the target are installed on top, so all targets share the layer of the common ones
+	if target := c.TargetInstall(); hasPipInstall(target) {
+		st = pipInstall(st, target, uv, opt, "[builder] pip install target dependencies")
+	}
+
+	return st, images, nil
+}
+
+func pipInstall(st llb.State, c *config.Config, uv llb.State, opt Opt, name string) llb.State {
+	runOpts := []llb.RunOption{
+		llb.Args(pipInstallArgs(c)),
+		installerMounts(c, uv, opt),
+		runOptions(opt, builderStage),
+		llb.WithCustomName(name),
+	}
+
+	if len(c.SshDependencies()) > 0 {
+		runOpts = append(runOpts, llb.AddSSHSocket())
+	}
+
+	if content, ok := generatedFiles(c)[hashedRequirements]; ok {
+		runOpts = append(runOpts, generatedFile(hashedRequirements, content))
+	}
+
+	for _, dep := range localDependencies(c) {
+		mountOpts := []llb.MountOption{llb.SourcePath(path.Join("/", dep.Source))}
+		if dep.Requirements {
+			mountOpts = append(mountOpts, llb.Readonly)
+		}
+		runOpts = append(runOpts, llb.AddMount(dep.Target, *opt.Context, mountOpts...))
+	}
+
+	return st.Run(runOpts...).Root()
+}
+
+func runtimeState(ctx context.Context, c *config.Config, builder llb.State, opt Opt) (llb.State, *dockerspec.DockerOCIImage, string, error) {
+	ref, distroless := runtimeBaseImage(c, targetPlatform(opt))
+	st, img, pinned, err := baseImage(ctx, ref, opt)
+	if err != nil {
+		return llb.State{}, nil, "", err
+	}
+
+	hasUser := distroless
+	if overriddenRuntime(c) {
+		hasUser, err = runtimeUserExists(ctx, c, ref, st, opt)
+		if err != nil {
+			return llb.State{}, nil, "", err
+		}
+		if !hasUser && !runtimeShellExists(ctx, st, opt) {
+			user := runtimeUserOf(c)
+			return llb.State{}, nil, "", errors.Errorf("runtime image %s has no user with uid %d and no shell to create it, add the user %s to the image", ref, user.Uid, user.Name)
+		}
+	}
+
+	if len(c.RuntimeDeps) > 0 {
+		cmd := runtimeAptCommand(c)
+		st = st.Run(
+			llb.Args([]string{"/bin/sh", "-c", cmd}),
+			llb.User("root"),
+			cacheMount(opt, "/var/cache/apt"),
+			cacheMount(opt, "/var/lib/apt"),
+			runOptions(opt, runtimeStage),
+			llb.WithCustomName("[runtime] "+cmd),
+		).Root()
+	}
+
+	// distroless images can't install the libraries the dependencies were built against, copy them from the builder
+	if (distroless || overriddenRuntime(c)) && c.HasDependencies() {
+		st = st.File(
+			llb.Copy(sharedLibraries(builder, st), "/", "/", &llb.CopyInfo{CopyDirContentsOnly: true}),
+			llb.WithCustomName("[runtime] copy shared libraries"),
+		)
+	}
+
+	user := runtimeUserOf(c)
+	if !hasUser {
+		st = st.Run(
+			llb.Args([]string{"/bin/sh", "-c", user.addCommand()}),
+			llb.User("root"),
+			runOptions(opt, runtimeStage),
+			llb.WithCustomName("[runtime] create user "+user.Name),
+		).Root()
+	}
+
+	st = st.User(user.String())
+	st, err = addEnvs(ctx, st, runtimeEnvs(c))
+	if err != nil {
+		return llb.State{}, nil, "", err
+	}
+
+	if c.HasDependencies() {
+		st = st.File(
+			llb.Copy(builder, "/root/.local/", user.LocalDir()+"/", &llb.CopyInfo{
+				CopyDirContentsOnly: true,
+				CreateDestPath:      true,
+			}, llb.WithUIDGID(user.Uid, user.Gid)),
+			llb.WithCustomName("[runtime] copy dependencies"),
+		)
+	}
+
+	if c.Project != "" {
+		target, workdir, _ := projectLayout(c)
+		st = st.File(
+			llb.Copy(*opt.Context, path.Join("/", c.Project), target, &llb.CopyInfo{
+				CopyDirContentsOnly: true,
+				CreateDestPath:      true,
+			}, llb.WithUIDGID(user.Uid, user.Gid)),
+			llb.WithCustomName("[runtime] copy project "+c.Project),
+		).Dir(workdir)
+	}
+
+	if c.Workdir != "" {
+		st = st.File(
+			llb.Mkdir(c.Workdir, 0755, llb.WithParents(true), llb.WithUIDGID(user.Uid, user.Gid)),
+			llb.WithCustomName("[runtime] mkdir "+c.Workdir),
+		).Dir(c.Workdir)
+	}
+
+	// like ENTRYPOINT and CMD of the rendered Dockerfile: the entrypoint resets the cmd of the base image, a cmd alone
+	// keeps the entrypoint of the base image
+	entrypoint, cmd := command(c)
+	if len(entrypoint) > 0 {
+		img.Config.Entrypoint = entrypoint
+		img.Config.Cmd = nil
+	}
+	if len(cmd) > 0 {
+		img.Config.Cmd = cmd
+	}
+
+	img.Config.User = user.String()
+	applyRuntimeConfig(c, img)
+	// like a Dockerfile, SOURCE_DATE_EPOCH sets the creation time for reproducible images
+	if opt.BuildConfig != nil && opt.BuildConfig.Epoch != nil {
+		img.Created = opt.BuildConfig.Epoch
+	}
+	img.Config.Env, err = st.Env(ctx)
+	if err != nil {
+		return llb.State{}, nil, "", err
+	}
+	img.Config.WorkingDir, err = st.GetDir(ctx)
+	if err != nil {
+		return llb.State{}, nil, "", err
+	}
+
+	sbom := ""
+	if sbomEnabled(c) {
+		sbom, err = installedSbom(ctx, c, builder, opt)
+		if err != nil {
+			return llb.State{}, nil, "", err
+		}
+	}
+
+	if img.Config.Labels == nil {
+		img.Config.Labels = map[string]string{}
+	}
+	for key, value := range imageLabels(c, sbom, pinned) {
+		img.Config.Labels[key] = value
+	}
+
+	return st, img, pinned, nil
+}
+
+// baseImage returns the state of the image ref together with its image config and the reference the state is built
+// from. The config is resolved by the MetaResolver if present and the image pinned to the resolved digest, otherwise an
+// empty config for the target platform is returned and the image is used as referenced.
+func baseImage(ctx context.Context, ref string, opt Opt) (llb.State, *dockerspec.DockerOCIImage, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return llb.State{}, nil, "", errors.Wrapf(err, "failed to parse image reference %s", ref)
+	}
+	named = reference.TagNameOnly(named)
+	ref = named.String()
+
+	p := targetPlatform(opt)
+
+	img := &dockerspec.DockerOCIImage{}
+	img.Platform = p
+	img.RootFS.Type = "layers"
+	img.Config.Env = []string{"PATH=" + system.DefaultPathEnv(p.OS)}
+
+	if opt.MetaResolver == nil {
+		st := llb.Image(ref, llb.Platform(p), resolveMode(opt))
+		return st.AddEnv("PATH", system.DefaultPathEnv(p.OS)).Platform(p), img, ref, nil
+	}
+
+	_, dgst, dt, err := opt.MetaResolver.ResolveImageConfig(ctx, ref, sourceresolver.Opt{
+		Platform: &p,
+		ImageOpt: &sourceresolver.ResolveImageOpt{ResolveMode: resolveMode(opt).String()},
+	})
+	if err != nil {
+		return llb.State{}, nil, "", errors.Wrapf(err, "failed to resolve image config of %s", ref)
+	}
+
+	// pin the image, so the build uses exactly the image the config was resolved from
+	if _, ok := named.(reference.Canonical); !ok && dgst != "" {
+		pinned, err := reference.WithDigest(named, dgst)
+		if err != nil {
+			return llb.State{}, nil, "", errors.Wrapf(err, "failed to pin %s to %s", ref, dgst)
+		}
+		ref = pinned.String()
+	}
+
+	if err := json.Unmarshal(dt, img); err != nil {
+		return llb.State{}, nil, "", errors.Wrapf(err, "failed to parse image config of %s", ref)
+	}
+
+	st, err := llb.Image(ref, llb.Platform(p), resolveMode(opt)).WithImageConfig(dt)
+	if err != nil {
+		return llb.State{}, nil, "", errors.Wrapf(err, "failed to apply image config of %s", ref)
+	}
+
+	return st.Platform(p), img, ref, nil
+}
+
+// applyRuntimeConfig sets the ports, volumes, healthcheck and stop signal of the final image.
+func applyRuntimeConfig(c *config.Config, img *dockerspec.DockerOCIImage) {
+	for _, port := range exposedPorts(c) {
+		if img.Config.ExposedPorts == nil {
+			img.Config.ExposedPorts = map[string]struct{}{}
+		}
+		img.Config.ExposedPorts[port] = struct{}{}
+	}
+
+	for _, volume := range c.Volumes {
+		if img.Config.Volumes == nil {
+			img.Config.Volumes = map[string]struct{}{}
+		}
+		img.Config.Volumes[volume] = struct{}{}
+	}
+
+	if c.Healthcheck != nil {
+		img.Config.Healthcheck = &dockerspec.HealthcheckConfig{
+			Test:     append([]string{"CMD"}, c.Healthcheck.Command...),
+			Interval: c.Healthcheck.Interval,
+			Timeout:  c.Healthcheck.Timeout,
+			Retries:  c.Healthcheck.Retries,
+		}
+	}
+
+	if c.StopSignal != "" {
+		img.Config.StopSignal = c.StopSignal
+	}
+}
+
+// runtimeUserExists checks if an overridden runtime image already provides the user, so distroless images without a
+// shell to create it work as well. Without ReadFile the image can't be inspected and the user is created if missing.
+func runtimeUserExists(ctx context.Context, c *config.Config, ref string, st llb.State, opt Opt) (bool, error) {
+	if opt.ReadFile == nil {
+		return false, nil
+	}
+
+	passwd, err := opt.ReadFile(ctx, st, "/etc/passwd")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read users of runtime image %s", ref)
+	}
+
+	user := runtimeUserOf(c)
+	for _, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[2] == strconv.Itoa(user.Uid) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// runtimeShellExists checks if an overridden runtime image has the shell the user is created with.
+func runtimeShellExists(ctx context.Context, st llb.State, opt Opt) bool {
+	if opt.StatFile == nil {
+		return true
+	}
+
+	// the image was already solved to read its users, so a failure means the shell is missing
+	_, err := opt.StatFile(ctx, st, "/bin/sh")
+	return err == nil
+}
+
+// addEnvs adds envs to the state in a stable order. Like a single Dockerfile ENV instruction, references to other
+// variables are expanded with the environment present before.
+func addEnvs(ctx context.Context, st llb.State, envs map[string]string) (llb.State, error) {
+	env, err := st.Env(ctx)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	lookup := map[string]string{}
+	for _, e := range env {
+		key, value, _ := strings.Cut(e, "=")
+		lookup[key] = value
+	}
+
+	for _, key := range sortedKeys(envs) {
+		st = st.AddEnv(key, os.Expand(envs[key], func(name string) string { return lookup[name] }))
+	}
+
+	return st, nil
+}
+
+// installerMounts mounts the cache of the installer, the uv binary of the uv image and the index credentials if required.
+func installerMounts(c *config.Config, uv llb.State, opt Opt) llb.RunOption {
+	return runOptionFunc(func(ei *llb.ExecInfo) {
+		cacheMount(opt, installerCacheDir(c)).SetRunOption(ei)
+
+		if c.Installer == config.InstallerUv {
+			llb.AddMount(uvBinary, uv, llb.SourcePath("/uv"), llb.Readonly).SetRunOption(ei)
+		}
+
+		secrets := indexSecrets(c)
+		for _, secret := range secrets {
+			llb.AddSecret(secret.Env, llb.SecretID(secret.ID), llb.SecretAsEnv(true)).SetRunOption(ei)
+		}
+		if len(secrets) > 0 {
+			generatedFile(indexRequirements, generatedFiles(c)[indexRequirements]).SetRunOption(ei)
+		}
+	})
+}
+
+// generatedFile mounts a file created by mopy with content at target.
+func generatedFile(target, content string) llb.RunOption {
+	name := "/" + path.Base(target)
+	st := llb.Scratch().File(llb.Mkfile(name, 0644, []byte(content)))
+
+	return llb.AddMount(target, st, llb.SourcePath(name), llb.Readonly)
+}
+
+type runOptionFunc func(*llb.ExecInfo)
+
+func (fn runOptionFunc) SetRunOption(ei *llb.ExecInfo) {
+	fn(ei)
+}
+
+func targetPlatform(opt Opt) ocispecs.Platform {
+	if opt.Platform != nil {
+		return *opt.Platform
+	}
+
+	return platforms.DefaultSpec()
+}
+
+// cacheMount mounts a persistent cache at target. Its id is prefixed by the cache id namespace of the client like the
+// cache mounts of a Dockerfile.
+func cacheMount(opt Opt, target string) llb.RunOption {
+	id := target
+	if opt.BuildConfig != nil && opt.BuildConfig.CacheIDNamespace != "" {
+		id = opt.BuildConfig.CacheIDNamespace + "/" + target
+	}
+
+	return llb.AddMount(target, llb.Scratch(), llb.AsPersistentCacheDir(id, llb.CacheMountShared))
+}
+
+// runOptions applies the proxies, extra hosts and network mode of the client and --no-cache to a run of the stage.
+func runOptions(opt Opt, stage string) llb.RunOption {
+	return runOptionFunc(func(ei *llb.ExecInfo) {
+		if opt.NoCache != nil && opt.NoCache(stage) {
+			llb.IgnoreCache.SetRunOption(ei)
+		}
+
+		cfg := opt.BuildConfig
+		if cfg == nil {
+			return
+		}
+		if proxy := proxyEnv(cfg.BuildArgs); proxy != nil {
+			llb.WithProxy(*proxy).SetRunOption(ei)
+		}
+		for _, host := range cfg.ExtraHosts {
+			llb.AddExtraHost(host.Host, host.IP).SetRunOption(ei)
+		}
+		ei.State = ei.State.Network(cfg.NetworkMode)
+	})
+}
+
+// proxyEnv returns the proxies set as build args, their names are case-insensitive like in a Dockerfile.
+func proxyEnv(args map[string]string) *llb.ProxyEnv {
+	proxy := &llb.ProxyEnv{}
+	for key, value := range args {
+		switch strings.ToLower(key) {
+		case "http_proxy":
+			proxy.HTTPProxy = value
+		case "https_proxy":
+			proxy.HTTPSProxy = value
+		case "ftp_proxy":
+			proxy.FTPProxy = value
+		case "no_proxy":
+			proxy.NoProxy = value
+		case "all_proxy":
+			proxy.AllProxy = value
+		}
+	}
+
+	if *proxy == (llb.ProxyEnv{}) {
+		return nil
+	}
+
+	return proxy
+}
+
+// resolveMode returns the image resolve mode of the client, --pull forces to pull the base images.
+func resolveMode(opt Opt) llb.ResolveMode {
+	if opt.BuildConfig == nil {
+		return llb.ResolveModeDefault
+	}
+
+	return opt.BuildConfig.ImageResolveMode
+}
@@ -0,0 +1,36 @@
+package llb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestProxyEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]string
+		want *llb.ProxyEnv
+	}{
+		{name: "none", args: map[string]string{"VERSION": "1.0"}},
+		{
+			name: "case insensitive",
+			args: map[string]string{"HTTP_PROXY": "http://proxy:3128", "https_proxy": "http://proxy:3128", "NO_PROXY": "localhost"},
+			want: &llb.ProxyEnv{HTTPProxy: "http://proxy:3128", HTTPSProxy: "http://proxy:3128", NoProxy: "localhost"},
+		},
+		{
+			name: "ftp and all",
+			args: map[string]string{"FTP_PROXY": "ftp://proxy", "ALL_PROXY": "socks5://proxy"},
+			want: &llb.ProxyEnv{FTPProxy: "ftp://proxy", AllProxy: "socks5://proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyEnv(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("proxyEnv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package llb
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+)
+
+const inventoryFile = "/out/sbom.json"
+
+// inventoryScript lists the distributions installed into the user site. It writes null if the interpreter is too old
+// to inspect them.
+const inventoryScript = `
+import json, site
+
+try:
+    from importlib.metadata import distributions
+except ImportError:
+    distributions = None
+
+def license(metadata):
+    expression = metadata.get("License-Expression")
+    if expression:
+        return expression
+    classifiers = [c.split(" :: ")[-1] for c in metadata.get_all("Classifier") or [] if c.startswith("License :: ")]
+    if classifiers:
+        return ", ".join(classifiers)
+    text = (metadata.get("License") or "").strip()
+    return text if "\n" not in text and len(text) <= 64 else ""
+
+inventory = None
+if distributions:
+    inventory = sorted(
+        ({"name": d.metadata["Name"], "version": d.version, "license": license(d.metadata)}
+         for d in distributions(path=[site.getusersitepackages()])),
+        key=lambda d: d["name"].lower(),
+    )
+
+with open("` + inventoryFile + `", "w") as f:
+    json.dump(inventory, f)
+`
+
+// distribution is a Python distribution installed in the builder stage.
+type distribution struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	License string `json:"license,omitempty"`
+}
+
+// installedSbom returns the sbom of the distributions actually installed in the builder, including transitive ones and
+// the content of requirements files and local packages. If they can't be inspected, the declared dependencies are used.
+func installedSbom(ctx context.Context, c *config.Config, builder llb.State, opt Opt) (string, error) {
+	if opt.ReadFile == nil || !c.HasDependencies() {
+		return sbom(c), nil
+	}
+
+	exec := builder.Run(
+		llb.Args([]string{"python", "-c", inventoryScript}),
+		llb.WithCustomName("[builder] inspect installed distributions"),
+	)
+	out := exec.AddMount("/out", llb.Scratch())
+
+	dt, err := opt.ReadFile(ctx, out, path.Base(inventoryFile))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to inspect installed distributions")
+	}
+
+	var distributions []distribution
+	if err := json.Unmarshal(dt, &distributions); err != nil {
+		return "", errors.Wrap(err, "failed to parse installed distributions")
+	}
+
+	if distributions == nil {
+		return sbom(c), nil
+	}
+
+	return toJson(distributions), nil
+}
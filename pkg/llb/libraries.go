@@ -0,0 +1,43 @@
+package llb
+
+import (
+	"github.com/moby/buildkit/client/llb"
+)
+
+const (
+	librariesDir   = "/libs"
+	runtimeRootDir = "/runtime"
+	librariesStage = "libraries"
+)
+
+// librariesScript collects the shared libraries the installed extension modules link against, which are missing in
+// the runtime image mounted at /runtime. They are copied below /libs with their resolved directory, so symlinked
+// directories like /lib in merged-usr images don't clash with the runtime image.
+const librariesScript = `set -e
+mkdir -p ` + librariesDir + `
+find /root/.local -type f -name '*.so*' -exec ldd {} + 2>/dev/null | awk '$2 == "=>" && $3 ~ /^\// { print $3 }' | sort -u |
+while read -r lib; do
+  case "$lib" in /root/.local/*) continue ;; esac
+  name=$(basename "$lib")
+  found=
+  for candidate in ` + runtimeRootDir + `/lib/"$name" ` + runtimeRootDir + `/lib/*/"$name" ` + runtimeRootDir + `/usr/lib/"$name" ` + runtimeRootDir + `/usr/lib/*/"$name"; do
+    if [ -e "$candidate" ] || [ -L "$candidate" ]; then found=1; fi
+  done
+  if [ -n "$found" ]; then continue; fi
+  dir=` + librariesDir + `$(realpath "$(dirname "$lib")")
+  mkdir -p "$dir"
+  cp -L "$lib" "$dir/$name"
+done
+`
+
+// sharedLibraries returns a state containing the shared libraries required by the installed dependencies, which the
+// runtime image doesn't provide. These are usually libraries installed by build-deps, like libpq or libopenblas.
+func sharedLibraries(builder, runtime llb.State) llb.State {
+	exec := builder.Run(
+		llb.Args([]string{"/bin/sh", "-c", librariesScript}),
+		llb.AddMount(runtimeRootDir, runtime, llb.Readonly),
+		llb.WithCustomName("[builder] collect shared libraries missing in the runtime image"),
+	)
+
+	return exec.AddMount(librariesDir, llb.Scratch())
+}
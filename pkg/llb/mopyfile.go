@@ -0,0 +1,501 @@
+package llb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+	"gitlab.com/cmdjulian/mopy/pkg/config"
+	"gitlab.com/cmdjulian/mopy/pkg/utils"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	poetryRequirements = "/tmp/poetry-requirements.txt"
+	hashedRequirements = "/tmp/pip-requirements.txt"
+	indexRequirements  = "/tmp/index-requirements.txt"
+	uvBinary           = "/usr/local/bin/uv"
+)
+
+var placeholderPattern = regexp.MustCompile(`^\$\{.+}$`)
+
+var defaultEnvs = map[string]string{
+	"PIP_DISABLE_PIP_VERSION_CHECK": "1",
+	"PIP_NO_WARN_SCRIPT_LOCATION":   "0",
+	"PIP_USER":                      "1",
+	"PYTHONPYCACHEPREFIX":           "$HOME/.pycache",
+	"GIT_SSH_COMMAND":               "ssh -o StrictHostKeyChecking=no",
+}
+
+var uvEnvs = map[string]string{
+	// the cache is a mount, uv can't hardlink from there
+	"UV_LINK_MODE": "copy",
+}
+
+// runtimeEnvs returns the environment of the final image including the configured envs and the ones of the target. The
+// user base is set explicitly, so the dependencies are found even if the container runs with an arbitrary uid without
+// home.
+func runtimeEnvs(c *config.Config) map[string]string {
+	envs := map[string]string{
+		"PYTHONUNBUFFERED": "1",
+		"PYTHONUSERBASE":   runtimeUserOf(c).LocalDir(),
+		"PATH":             "$PATH:" + runtimeUserOf(c).LocalDir() + "/bin",
+	}
+
+	return utils.Union(utils.Union(envs, c.Envs), c.TargetEnvs)
+}
+
+// runtimeUser is the user of the final image with the defaults applied.
+type runtimeUser struct {
+	Name string
+	Uid  int
+	Gid  int
+	Home string
+}
+
+func runtimeUserOf(c *config.Config) runtimeUser {
+	user := runtimeUser{Name: "nonroot", Uid: 65532}
+	if c.User != nil {
+		if c.User.Name != "" {
+			user.Name = c.User.Name
+		}
+		if c.User.Uid != nil {
+			user.Uid = *c.User.Uid
+		}
+		user.Home = c.User.Home
+	}
+
+	user.Gid = user.Uid
+	if c.User != nil && c.User.Gid != nil {
+		user.Gid = *c.User.Gid
+	}
+	if user.Home == "" {
+		user.Home = "/home/" + user.Name
+	}
+
+	return user
+}
+
+// String returns the user as uid:gid.
+func (u runtimeUser) String() string {
+	return fmt.Sprintf("%d:%d", u.Uid, u.Gid)
+}
+
+// LocalDir returns the folder the dependencies are installed to.
+func (u runtimeUser) LocalDir() string {
+	return path.Join(u.Home, ".local")
+}
+
+// addCommand returns the shell command creating the user in images not providing it. An existing user with the uid is
+// kept, as overridden runtime images can't always be inspected before.
+func (u runtimeUser) addCommand() string {
+	if u.Gid == u.Uid {
+		return fmt.Sprintf("getent passwd %d >/dev/null || useradd --uid=%d --user-group --home-dir=%s --create-home %s", u.Uid, u.Uid, u.Home, u.Name)
+	}
+
+	// an existing group with the gid, like root, is reused. groupadd --force doesn't cover this, it only accepts an
+	// existing group name and picks another gid if the gid is taken
+	group := fmt.Sprintf("{ getent group %d >/dev/null || groupadd --gid=%d %s; }", u.Gid, u.Gid, u.Name)
+	return fmt.Sprintf("getent passwd %d >/dev/null || { %s && useradd --uid=%d --gid=%d --home-dir=%s --create-home %s; }", u.Uid, group, u.Uid, u.Gid, u.Home, u.Name)
+}
+
+var defaulLabels = map[string]string{
+	"org.opencontainers.image.description": "autogenerated by mopy",
+	"moby.buildkit.frontend":               "mopy",
+	"mopy.version":                         "v1",
+}
+
+// indexSecret is a BuildKit secret holding the credentials of an index, exposed as environment variable.
+type indexSecret struct {
+	ID  string
+	Env string
+}
+
+// localDependency is a dependency taken from the build context and the path it is made available at in the builder.
+type localDependency struct {
+	Source       string
+	Target       string
+	Requirements bool
+	Extras       []string
+}
+
+func localDependencies(c *config.Config) []localDependency {
+	var deps []localDependency
+
+	for i, s := range c.LocalDependencies() {
+		if strings.HasSuffix(s, "/requirements.txt") {
+			deps = append(deps, localDependency{
+				Source:       s,
+				Target:       fmt.Sprintf("/tmp/%drequirements.txt", i),
+				Requirements: true,
+			})
+		} else {
+			s = strings.TrimSuffix(s, "/")
+			source := strings.TrimPrefix(s, "./")
+			deps = append(deps, localDependency{
+				Source: source,
+				Target: fmt.Sprintf("/tmp/%d%s/", i, utils.After(s, "/")),
+			})
+		}
+	}
+
+	if c.Pyproject != nil {
+		source := strings.TrimSuffix(strings.TrimPrefix(c.Pyproject.Dir(), "./"), "/")
+		if source == "" {
+			source = "."
+		}
+		deps = append(deps, localDependency{
+			Source: source,
+			Target: "/tmp/pyproject/",
+			Extras: c.Pyproject.Extras,
+		})
+	}
+
+	return deps
+}
+
+// builderEnvs returns the environment of the builder stage.
+func builderEnvs(c *config.Config) map[string]string {
+	envs := defaultEnvs
+	if c.Installer == config.InstallerUv {
+		envs = utils.Union(envs, uvEnvs)
+	}
+
+	return utils.Union(envs, c.Envs)
+}
+
+// installCommand returns the command installing packages with the configured installer. uv has no user installs, so
+// the user site of root is used as its prefix instead.
+func installCommand(c *config.Config) []string {
+	if c.Installer == config.InstallerUv {
+		return []string{"uv", "pip", "install", "--system", "--prefix", "/root/.local"}
+	}
+
+	return []string{"pip", "install"}
+}
+
+// installerCacheDir returns the cache directory of the configured installer.
+func installerCacheDir(c *config.Config) string {
+	if c.Installer == config.InstallerUv {
+		return "/root/.cache/uv"
+	}
+
+	return "/root/.cache"
+}
+
+// pipInstallArgs returns the complete installer invocation installing all dependencies of the Mopyfile.
+func pipInstallArgs(c *config.Config) []string {
+	args := installCommand(c)
+	if c.RequireHashes {
+		args = append(args, "--require-hashes")
+	}
+	args = append(args, indexArgs(c)...)
+
+	for _, dep := range localDependencies(c) {
+		switch {
+		case dep.Requirements:
+			args = append(args, "-r", dep.Target)
+		case len(dep.Extras) > 0:
+			args = append(args, fmt.Sprintf("%s[%s]", strings.TrimSuffix(dep.Target, "/"), strings.Join(dep.Extras, ",")))
+		default:
+			args = append(args, dep.Target)
+		}
+	}
+
+	// hashes can only be passed in a requirements file
+	if c.RequireHashes && len(c.PyPiDependencies()) > 0 {
+		args = append(args, "-r", hashedRequirements)
+	} else {
+		args = append(args, c.PyPiDependencies()...)
+	}
+	args = append(args, c.HttpDependencies()...)
+	args = append(args, c.SshDependencies()...)
+
+	return args
+}
+
+// hasPipInstall reports if there are dependencies to install besides the ones of a poetry.lock.
+func hasPipInstall(c *config.Config) bool {
+	return len(c.PipDependencies) > 0 || c.Pyproject != nil
+}
+
+// poetryInstallArgs returns the pip invocation installing the hash pinned packages of the poetry.lock. As the lock is
+// complete, dependencies are not resolved again.
+func poetryInstallArgs(c *config.Config) []string {
+	args := append(installCommand(c), "--no-deps", "--require-hashes")
+	args = append(args, indexArgs(c)...)
+
+	return append(args, "-r", poetryRequirements)
+}
+
+// generatedFiles returns the files mopy creates in the builder stage, mapped to their content.
+func generatedFiles(c *config.Config) map[string]string {
+	files := map[string]string{}
+
+	if c.Poetry != nil {
+		files[poetryRequirements] = c.Poetry.Requirements()
+	}
+
+	if c.RequireHashes && len(c.PyPiDependencies()) > 0 {
+		files[hashedRequirements] = strings.Join(c.PyPiDependencies(), "\n") + "\n"
+	}
+
+	if lines := secretIndexLines(c); len(lines) > 0 {
+		files[indexRequirements] = strings.Join(lines, "\n") + "\n"
+	}
+
+	return files
+}
+
+func indexArgs(c *config.Config) []string {
+	if len(c.Indices) <= 0 {
+		return nil
+	}
+
+	var args []string
+	if c.Installer != config.InstallerUv {
+		// uv retries on its own and has no flag for it
+		args = append(args, "--retries", "2")
+	}
+
+	for i, index := range c.Indices {
+		indexUrl := index.URL()
+
+		if index.Secret != "" {
+			// the url is part of the index requirements file, so the credentials only get expanded by the installer
+			if index.Trust {
+				args = append(args, "--trusted-host", indexUrl.Host)
+			}
+			continue
+		}
+
+		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) == 0 {
+			indexUrl.User = url.User(index.Username)
+		}
+
+		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) != 0 {
+			indexUrl.User = url.UserPassword(index.Username, index.Password)
+		}
+
+		args = append(args, indexFlag(c, i), indexUrl.String())
+
+		if index.Trust {
+			args = append(args, "--trusted-host", indexUrl.Host)
+		}
+	}
+
+	if len(indexSecrets(c)) > 0 {
+		args = append(args, "-r", indexRequirements)
+	}
+
+	return args
+}
+
+// indexFlag returns the installer flag for the index at position i, the primary index replaces PyPI.
+func indexFlag(c *config.Config, i int) string {
+	if c.PrimaryIndex() == i {
+		return "--index-url"
+	}
+
+	return "--extra-index-url"
+}
+
+func indexSecrets(c *config.Config) []indexSecret {
+	var secrets []indexSecret
+
+	for i, index := range c.Indices {
+		if index.Secret != "" {
+			secrets = append(secrets, indexSecret{ID: index.Secret, Env: fmt.Sprintf("MOPY_INDEX_SECRET_%d", i)})
+		}
+	}
+
+	return secrets
+}
+
+// secretIndexLines returns the index options of indices with a secret. Their credentials are a reference to the
+// secret's environment variable, which is expanded by the installer when reading the requirements file.
+func secretIndexLines(c *config.Config) []string {
+	var lines []string
+
+	for i, index := range c.Indices {
+		if index.Secret == "" {
+			continue
+		}
+
+		indexUrl := index.URL()
+		indexUrl.User = nil
+
+		credentials := fmt.Sprintf("${MOPY_INDEX_SECRET_%d}", i)
+		if len(strings.TrimSpace(index.Username)) != 0 {
+			credentials = url.User(index.Username).String() + ":" + credentials
+		}
+
+		withoutScheme := strings.TrimPrefix(indexUrl.String(), indexUrl.Scheme+"://")
+		lines = append(lines, fmt.Sprintf("%s %s://%s@%s", indexFlag(c, i), indexUrl.Scheme, credentials, withoutScheme))
+	}
+
+	return lines
+}
+
+// aptPackages returns the packages to install into the builder stage, git-lfs is added for vcs dependencies.
+func aptPackages(c *config.Config) []string {
+	var packages []string
+
+	target := c.TargetInstall()
+	if len(c.HttpDependencies()) > 0 || len(c.SshDependencies()) > 0 || len(target.HttpDependencies()) > 0 || len(target.SshDependencies()) > 0 {
+		packages = append(packages, "git-lfs")
+	}
+
+	return append(packages, c.Apt...)
+}
+
+// runtimeAptCommand returns the command installing the runtime dependencies into the final image.
+func runtimeAptCommand(c *config.Config) string {
+	return "apt update && apt install -y --no-install-recommends " + strings.Join(c.RuntimeDeps, " ")
+}
+
+// imageLabels returns all labels of the final image, user supplied labels have precedence over generated ones. The
+// sbom is only added to the labels if enabled. base is the reference of the runtime base image.
+func imageLabels(c *config.Config, sbom string, base string) map[string]string {
+	labels := map[string]string{
+		"mopy.python.version": c.PythonVersion,
+	}
+
+	maps.Copy(labels, defaulLabels)
+	maps.Copy(labels, baseImageLabels(base))
+
+	// add sbom if required
+	if sbomEnabled(c) {
+		labels["mopy.sbom"] = sbom
+	}
+
+	// allow replacement of labels with placeholder lookup
+	all := utils.Union(labels, c.Labels)
+	for key, value := range c.Labels {
+		if placeholderPattern.MatchString(value) {
+			labels[key] = all[value[2:len(value)-1]]
+		} else {
+			labels[key] = value
+		}
+	}
+
+	return labels
+}
+
+// baseImageLabels returns the OCI annotations of the base image ref. The digest is only known for pinned references.
+func baseImageLabels(ref string) map[string]string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil
+	}
+	named = reference.TagNameOnly(named)
+
+	name := reference.TrimNamed(named).String()
+	if tagged, ok := named.(reference.Tagged); ok {
+		name += ":" + tagged.Tag()
+	}
+	labels := map[string]string{"org.opencontainers.image.base.name": name}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		labels["org.opencontainers.image.base.digest"] = canonical.Digest().String()
+	}
+
+	return labels
+}
+
+func sbomEnabled(c *config.Config) bool {
+	return c.Sbom == nil || *c.Sbom
+}
+
+// sbom returns the declared dependencies as json list. It is used when the installed distributions can't be inspected.
+func sbom(c *config.Config) string {
+	dependencies := append([]string{}, c.MaskedDependencies()...)
+
+	// the pyproject is listed by its name followed by its declared dependencies
+	if c.Pyproject != nil && c.Pyproject.Name != "" {
+		project := c.Pyproject.Name
+		if c.Pyproject.Version != "" {
+			project += "==" + c.Pyproject.Version
+		}
+		dependencies = append(dependencies, project)
+		dependencies = append(dependencies, c.Pyproject.Dependencies...)
+	}
+
+	// locked packages are listed with their exact version
+	if c.Poetry != nil {
+		for _, pkg := range c.Poetry.Packages {
+			dependencies = append(dependencies, fmt.Sprintf("%s==%s", pkg.Name, pkg.Version))
+		}
+	}
+
+	return toJson(dependencies)
+}
+
+func toJson(v any) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// command returns the entrypoint and cmd of the final image. Without any configuration, a project is run with python.
+// Console scripts are started through python, as their shebang points to the interpreter of the build stage.
+func command(c *config.Config) ([]string, []string) {
+	var entrypoint, cmd []string
+
+	switch {
+	case len(c.Entrypoint) > 0:
+		entrypoint = c.Entrypoint
+	case c.Module != "":
+		entrypoint = []string{"python", "-m", c.Module}
+	case c.Script != "":
+		entrypoint = []string{"python", path.Join(runtimeUserOf(c).LocalDir(), "bin", c.Script)}
+	case c.Project != "":
+		_, _, file := projectLayout(c)
+		entrypoint = []string{"python"}
+		cmd = []string{file}
+	}
+
+	if len(c.Cmd) > 0 {
+		cmd = c.Cmd
+	}
+
+	return entrypoint, cmd
+}
+
+// exposedPorts returns the ports to expose with their protocol, tcp is used if none is set.
+func exposedPorts(c *config.Config) []string {
+	ports := make([]string, len(c.Expose))
+	for i, port := range c.Expose {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		ports[i] = port
+	}
+
+	return ports
+}
+
+// projectLayout returns the path the project is copied to in the final image, the working directory and the python
+// file to run. The file is absolute, so it is found even if the working directory is changed by workdir.
+func projectLayout(c *config.Config) (string, string, string) {
+	project := strings.TrimSuffix(c.Project, "/")
+	home := runtimeUserOf(c).Home
+	target := path.Join(home, utils.After(project, "/"))
+
+	if strings.HasSuffix(c.Project, ".py") {
+		return target, home, target
+	}
+
+	return target, target, path.Join(target, "main.py")
+}